@@ -1,6 +1,7 @@
 #!/usr/bin/env bash
 
-./build/build.sh
+# static binary for the scratch image (without cgo, so without SQLite)
+CGO_ENABLED=0 ./build/build.sh
 
 buildah from --name puzzlerightserver-working-container scratch
 buildah copy puzzlerightserver-working-container $HOME/go/bin/puzzlerightserver /bin/puzzlerightserver
@@ -0,0 +1,412 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/dvaumoron/puzzlerightserver/migration"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	migrateUsage  = "usage: puzzlerightserver migrate up|down|status|baseline version"
+	exportUsage   = "usage: puzzlerightserver export [-format json|yaml]"
+	importUsage   = "usage: puzzlerightserver import [-replace] [-dry-run] file.json|file.yaml"
+	deleteUsage   = "usage: puzzlerightserver delete-objects objectId..."
+	renameUsage   = "usage: puzzlerightserver rename-role [-merge] [-force] oldName newName"
+	copyUsage     = "usage: puzzlerightserver copy-object [-users] [-overwrite] sourceObjectId targetObjectId"
+	copyUserUsage = "usage: puzzlerightserver copy-user [-transfer] [-objects id,...] sourceUserId targetUserId"
+
+	jsonFormat = "json"
+	yamlFormat = "yaml"
+)
+
+var (
+	errMigrateUsage  = errors.New(migrateUsage)
+	errExportUsage   = errors.New(exportUsage)
+	errImportUsage   = errors.New(importUsage)
+	errDeleteUsage   = errors.New(deleteUsage)
+	errRenameUsage   = errors.New(renameUsage)
+	errCopyUsage     = errors.New(copyUsage)
+	errCopyUserUsage = errors.New(copyUserUsage)
+
+	errRenameNotNotified = errors.New("the running servers would keep the old name until restarted (notifications need Postgres and DB_NOTIFY_CHANNEL), stop them or use -force")
+)
+
+func runCommand(name string, args []string) {
+	// same environment loading as the server
+	godotenv.Overload()
+
+	var err error
+	switch name {
+	case "migrate":
+		err = migrateCommand(args)
+	case "export":
+		err = exportCommand(args)
+	case "import":
+		err = importCommand(args)
+	case "delete-objects":
+		err = deleteObjectsCommand(args)
+	case "rename-role":
+		err = renameRoleCommand(args)
+	case "copy-object":
+		err = copyObjectCommand(args)
+	case "copy-user":
+		err = copyUserCommand(args)
+	default:
+		err = fmt.Errorf("unknown command %q", name)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func migrateCommand(args []string) error {
+	// only baseline takes an argument
+	argCount := 1
+	if len(args) != 0 && args[0] == "baseline" {
+		argCount = 2
+	}
+	if len(args) != argCount {
+		return errMigrateUsage
+	}
+
+	db, dialect, err := openDB(os.Getenv("DB_SERVER_ADDR"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migration.New(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, appliedMigration := range applied {
+			fmt.Println("Applied", appliedMigration.Version, appliedMigration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Already up to date")
+		}
+		return err
+	case "down":
+		reverted, ok, err := migrator.Down(ctx)
+		if ok {
+			fmt.Println("Reverted", reverted.Version, reverted.Name)
+		} else if err == nil {
+			fmt.Println("Nothing to revert")
+		}
+		return err
+	case "baseline":
+		version, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		marked, err := migrator.Baseline(ctx, version)
+		for _, markedMigration := range marked {
+			fmt.Println("Marked as applied", markedMigration.Version, markedMigration.Name)
+		}
+		if err == nil && len(marked) == 0 {
+			fmt.Println("Nothing to mark")
+		}
+		return err
+	case "status":
+		states, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, state := range states {
+			status := "pending"
+			if state.Applied {
+				status = "applied"
+			}
+			fmt.Println(state.Version, state.Name, status)
+		}
+		return nil
+	}
+	return errMigrateUsage
+}
+
+func exportCommand(args []string) error {
+	flagSet := flag.NewFlagSet("export", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	format := flagSet.String("format", jsonFormat, "")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 0 {
+		return errExportUsage
+	}
+
+	var encode func(any) error
+	switch *format {
+	case jsonFormat:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encode = encoder.Encode
+	case yamlFormat:
+		encode = yaml.NewEncoder(os.Stdout).Encode
+	default:
+		return errExportUsage
+	}
+
+	// the reads of the export see the same state
+	store, db, err := openStoreAtLeast(sql.LevelRepeatableRead)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	snapshot, err := rightserver.ExportSnapshot(context.Background(), store)
+	if err != nil {
+		return err
+	}
+	return encode(snapshot)
+}
+
+func importCommand(args []string) error {
+	flagSet := flag.NewFlagSet("import", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	replace := flagSet.Bool("replace", false, "")
+	dryRun := flagSet.Bool("dry-run", false, "")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 1 {
+		return errImportUsage
+	}
+
+	snapshot, err := readSnapshot(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	store, db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	mode := rightserver.MergeImport
+	if *replace {
+		mode = rightserver.ReplaceImport
+	}
+
+	changes, err := rightserver.ImportSnapshot(context.Background(), store, snapshot, mode, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	switch {
+	case len(changes) == 0:
+		fmt.Println("Already up to date")
+	case *dryRun:
+		fmt.Println("Dry run,", len(changes), "changes not applied")
+	default:
+		fmt.Println("Applied", len(changes), "changes")
+	}
+	return nil
+}
+
+func deleteObjectsCommand(args []string) error {
+	if len(args) == 0 {
+		return errDeleteUsage
+	}
+
+	objectIds := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		objectId, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return errDeleteUsage
+		}
+		objectIds = append(objectIds, objectId)
+	}
+
+	store, db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	counts, err := rightserver.DeleteObjects(context.Background(), store, objectIds)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Deleted", counts.Roles, "roles,", counts.UserRoles, "user roles and", counts.RoleNames, "role names")
+	return nil
+}
+
+func renameRoleCommand(args []string) error {
+	flagSet := flag.NewFlagSet("rename-role", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	merge := flagSet.Bool("merge", false, "")
+	force := flagSet.Bool("force", false, "")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 2 {
+		return errRenameUsage
+	}
+	// the servers cache the role names by id
+	if !*force && notifyChannelFor(dialectFor(os.Getenv("DB_SERVER_ADDR"))) == "" {
+		return errRenameNotNotified
+	}
+
+	store, db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	oldName, newName := flagSet.Arg(0), flagSet.Arg(1)
+	if err = rightserver.RenameRole(context.Background(), store, oldName, newName, *merge); err != nil {
+		return err
+	}
+
+	fmt.Println("Renamed", oldName, "to", newName)
+	return nil
+}
+
+func copyObjectCommand(args []string) error {
+	flagSet := flag.NewFlagSet("copy-object", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	includeUsers := flagSet.Bool("users", false, "")
+	overwrite := flagSet.Bool("overwrite", false, "")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 2 {
+		return errCopyUsage
+	}
+
+	sourceId, err := strconv.ParseUint(flagSet.Arg(0), 10, 64)
+	if err != nil {
+		return err
+	}
+	targetId, err := strconv.ParseUint(flagSet.Arg(1), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	store, db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	counts, err := rightserver.CopyObjectRights(context.Background(), store, sourceId, targetId, *includeUsers, *overwrite)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Copied", counts.Roles, "roles and", counts.UserRoles, "user roles")
+	return nil
+}
+
+func copyUserCommand(args []string) error {
+	flagSet := flag.NewFlagSet("copy-user", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	transfer := flagSet.Bool("transfer", false, "")
+	objectIdsStr := flagSet.String("objects", "", "")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 2 {
+		return errCopyUserUsage
+	}
+
+	sourceUserId, err := strconv.ParseUint(flagSet.Arg(0), 10, 64)
+	if err != nil {
+		return err
+	}
+	targetUserId, err := strconv.ParseUint(flagSet.Arg(1), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var objectIds []uint64
+	if *objectIdsStr != "" {
+		if objectIds, err = parseObjectIds(*objectIdsStr); err != nil {
+			return err
+		}
+	}
+
+	store, db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	granted, err := rightserver.CopyUserRights(context.Background(), store, sourceUserId, targetUserId, objectIds, *transfer)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Granted", granted, "roles to user", targetUserId)
+	return nil
+}
+
+// the format is chosen from the file extension
+func readSnapshot(path string) (rightserver.Snapshot, error) {
+	var snapshot rightserver.Snapshot
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &snapshot)
+	default:
+		err = json.Unmarshal(data, &snapshot)
+	}
+	return snapshot, err
+}
+
+func openStore() (rightserver.Store, *sql.DB, error) {
+	return openStoreAtLeast(sql.LevelDefault)
+}
+
+// the transactions use minIsolation when DB_TX_ISOLATION asks for a lower level
+func openStoreAtLeast(minIsolation sql.IsolationLevel) (rightserver.Store, *sql.DB, error) {
+	db, dialect, err := openDB(os.Getenv("DB_SERVER_ADDR"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isolation, err := parseIsolationLevel(os.Getenv("DB_TX_ISOLATION"))
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	if isolation < minIsolation {
+		isolation = minIsolation
+	}
+	// the running servers are notified of the imported changes
+	return rightserver.NewSQLStore(db, retryableFor(dialect), isolation, notifyChannelFor(dialect)), db, nil
+}
@@ -0,0 +1,330 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dialects with embedded migrations
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+const (
+	upSuffix   = ".up.sql"
+	downSuffix = ".down.sql"
+
+	createVersionTableQuery = "create table if not exists schema_migrations (version bigint primary key, name varchar(255) not null, applied_at timestamp not null);"
+	readVersionsQuery       = "select m.version from schema_migrations as m;"
+	countVersionQuery       = "select count(*) from schema_migrations as m where m.version = $1;"
+	insertVersionQuery      = "insert into schema_migrations(version, name, applied_at) values($1, $2, current_timestamp);"
+	deleteVersionQuery      = "delete from schema_migrations where version = $1;"
+
+	// Postgres only, the lock is held by the session, so it is released if the process dies
+	lockQuery   = "select pg_advisory_lock($1);"
+	unlockQuery = "select pg_advisory_unlock($1);"
+
+	// arbitrary key shared by all the instances migrating the same database
+	lockKey int64 = 7_138_455_201
+)
+
+var (
+	errMissingDown    = errors.New("migration without down script")
+	errUnknownVersion = errors.New("unknown migration version")
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var scriptsFS embed.FS
+
+type Migration struct {
+	Version uint64
+	Name    string
+	up      string
+	down    string
+}
+
+type State struct {
+	Migration
+	Applied bool
+}
+
+// Migrator applies the embedded migrations and tracks them in the schema_migrations table.
+//
+// Instances migrating the same database at the same time wait for each other (with an advisory lock on Postgres),
+// a migration applied by another instance meanwhile is skipped.
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+func New(db *sql.DB, dialect string) (Migrator, error) {
+	migrations, err := loadMigrations(scriptsFS, dialect)
+	return Migrator{db: db, dialect: dialect, migrations: migrations}, err
+}
+
+// Apply all the pending migrations in version order, each one in its own transaction.
+func (m Migrator) Up(ctx context.Context) ([]Migration, error) {
+	done := []Migration{}
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := readApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			ran, err := run(ctx, conn, migration.up, true, insertVersionQuery, migration.Version, migration.Name)
+			if err != nil {
+				return err
+			}
+			if ran {
+				done = append(done, migration)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Revert the last applied migration, the returned boolean is false when there was nothing to revert.
+func (m Migrator) Down(ctx context.Context) (Migration, bool, error) {
+	var reverted Migration
+	var ok bool
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := readApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for index := len(m.migrations) - 1; index >= 0; index-- {
+			migration := m.migrations[index]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			reverted = migration
+			if migration.down == "" {
+				return errMissingDown
+			}
+			ok, err = run(ctx, conn, migration.down, false, deleteVersionQuery, migration.Version)
+			return err
+		}
+		return nil
+	})
+	return reverted, ok, err
+}
+
+// Baseline records the migrations up to version as applied without running them,
+// for a database whose schema was created by other means (like by hand before the migrations existed).
+func (m Migrator) Baseline(ctx context.Context, version uint64) ([]Migration, error) {
+	known := false
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, errUnknownVersion
+	}
+
+	done := []Migration{}
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := readApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if migration.Version > version {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			if _, err = conn.ExecContext(ctx, insertVersionQuery, migration.Version, migration.Name); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func (m Migrator) Status(ctx context.Context) ([]State, error) {
+	var states []State
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := readApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		states = make([]State, 0, len(m.migrations))
+		for _, migration := range m.migrations {
+			_, ok := applied[migration.Version]
+			states = append(states, State{Migration: migration, Applied: ok})
+		}
+		return nil
+	})
+	return states, err
+}
+
+// call f with a dedicated connection, holding the advisory lock on Postgres
+// (SQLite transactions take the write lock at their start, so run checks the version again)
+func (m Migrator) withLock(ctx context.Context, f func(*sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect == Postgres {
+		if _, err = conn.ExecContext(ctx, lockQuery, lockKey); err != nil {
+			return err
+		}
+		defer func() {
+			if _, unlockErr := conn.ExecContext(ctx, unlockQuery, lockKey); err == nil {
+				err = unlockErr
+			}
+		}()
+	}
+	return f(conn)
+}
+
+func readApplied(ctx context.Context, conn *sql.Conn) (map[uint64]struct{}, error) {
+	if _, err := conn.ExecContext(ctx, createVersionTableQuery); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, readVersionsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[uint64]struct{}{}
+	for rows.Next() {
+		var version uint64
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = struct{}{}
+	}
+	return applied, rows.Err()
+}
+
+// run the script and the version bookkeeping in the same transaction,
+// the returned boolean is false when another instance did it first (the version is already applied when up is true)
+func run(ctx context.Context, conn *sql.Conn, script string, up bool, versionQuery string, version uint64, versionArgs ...any) (ran bool, err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err == nil && ran {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	var count int
+	if err = tx.QueryRowContext(ctx, countVersionQuery, version).Scan(&count); err != nil {
+		return false, err
+	}
+	if up == (count != 0) {
+		return false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, versionQuery, append([]any{version}, versionArgs...)...)
+	return err == nil, err
+}
+
+// file names follow the pattern "<version>_<name>.up.sql" and "<version>_<name>.down.sql"
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	versionToMigration := map[uint64]*Migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var baseName string
+		up := strings.HasSuffix(fileName, upSuffix)
+		switch {
+		case up:
+			baseName = strings.TrimSuffix(fileName, upSuffix)
+		case strings.HasSuffix(fileName, downSuffix):
+			baseName = strings.TrimSuffix(fileName, downSuffix)
+		default:
+			continue
+		}
+
+		versionStr, name, _ := strings.Cut(baseName, "_")
+		version, err := strconv.ParseUint(versionStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		migration := versionToMigration[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: name}
+			versionToMigration[version] = migration
+		}
+		if up {
+			migration.up = string(data)
+		} else {
+			migration.down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(versionToMigration))
+	for _, migration := range versionToMigration {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
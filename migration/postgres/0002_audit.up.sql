@@ -0,0 +1,14 @@
+create table if not exists audit_entries (
+	id bigserial primary key,
+	rpc varchar(64) not null,
+	user_id bigint not null,
+	object_id bigint not null,
+	role_name varchar(255) not null,
+	before_flags smallint not null,
+	after_flags smallint not null,
+	created_at timestamptz not null
+);
+
+create index if not exists audit_entries_user_id_idx on audit_entries (user_id);
+create index if not exists audit_entries_object_id_idx on audit_entries (object_id);
+create index if not exists audit_entries_created_at_idx on audit_entries (created_at);
@@ -0,0 +1 @@
+alter table roles add column if not exists version bigint not null default 0;
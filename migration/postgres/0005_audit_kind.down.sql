@@ -0,0 +1,3 @@
+drop index if exists audit_entries_kind_idx;
+
+alter table audit_entries drop column kind;
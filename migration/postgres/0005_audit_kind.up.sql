@@ -0,0 +1,7 @@
+-- role for a change of the role itself, user_role for a change of the roles of user_id (which can be 0, the anonymous user)
+alter table audit_entries add column if not exists kind varchar(16) not null default 'role';
+
+-- before this column, only the imports can be ambiguous (user_id 0 is taken as a role change)
+update audit_entries set kind = 'user_role' where user_id <> 0 or rpc in ('UpdateUser', 'CopyUserRights');
+
+create index if not exists audit_entries_kind_idx on audit_entries (kind);
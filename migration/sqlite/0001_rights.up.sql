@@ -0,0 +1,26 @@
+-- "if not exists" lets an existing hand-written schema be adopted
+create table if not exists role_names (
+	id integer primary key autoincrement,
+	name varchar(255) not null
+);
+
+create unique index if not exists role_names_name_key on role_names (name);
+
+create table if not exists roles (
+	id integer primary key autoincrement,
+	name_id integer not null references role_names (id),
+	object_id integer not null,
+	action_flags smallint not null
+);
+
+create unique index if not exists roles_name_id_object_id_key on roles (name_id, object_id);
+create index if not exists roles_object_id_idx on roles (object_id);
+
+create table if not exists user_roles (
+	id integer primary key autoincrement,
+	user_id integer not null,
+	role_id integer not null references roles (id) on delete cascade
+);
+
+create unique index if not exists user_roles_user_id_role_id_key on user_roles (user_id, role_id);
+create index if not exists user_roles_role_id_idx on user_roles (role_id);
@@ -0,0 +1,3 @@
+drop table object_attributes;
+drop table objects;
+drop table user_attributes;
@@ -0,0 +1,25 @@
+create table if not exists user_attributes (
+	id integer primary key autoincrement,
+	user_id integer not null,
+	name varchar(255) not null,
+	value text not null,
+	constraint user_attributes_user_id_name_key unique (user_id, name)
+);
+
+create table if not exists objects (
+	id integer primary key autoincrement,
+	object_id integer not null,
+	object_type varchar(255) not null,
+	name varchar(255) not null,
+	constraint objects_object_id_key unique (object_id)
+);
+
+create index if not exists objects_object_type_idx on objects (object_type);
+
+create table if not exists object_attributes (
+	id integer primary key autoincrement,
+	object_id integer not null references objects (object_id) on delete cascade,
+	name varchar(255) not null,
+	value text not null,
+	constraint object_attributes_object_id_name_key unique (object_id, name)
+);
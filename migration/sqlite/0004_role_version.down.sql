@@ -0,0 +1 @@
+alter table roles drop column version;
@@ -0,0 +1 @@
+alter table roles add column version integer not null default 0;
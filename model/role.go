@@ -9,19 +9,21 @@ type Role struct {
 	NameId      uint64
 	ObjectId    uint64
 	ActionFlags uint8
+	Version     uint64
 }
 
-func MakeRole(id uint64, nameId uint64, objectId uint64, actionFlags uint8) Role {
+func MakeRole(id uint64, nameId uint64, objectId uint64, actionFlags uint8, version uint64) Role {
 	return Role{
 		ActionFlags: actionFlags,
 		Id:          id,
 		NameId:      nameId,
 		ObjectId:    objectId,
+		Version:     version,
 	}
 }
 
 func (o Role) Create(pool ExecerContext, ctx context.Context) error {
-	_, err := createRole(pool, ctx, o.NameId, o.ObjectId, o.ActionFlags)
+	_, err := createRole(pool, ctx, o.NameId, o.ObjectId, o.ActionFlags, o.Version)
 	return err
 }
 
@@ -29,17 +31,18 @@ func ReadRole(pool RowQueryerContext, ctx context.Context, id uint64) (Role, err
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := "select o.id, o.name_id, o.object_id, o.action_flags from roles as o where o.id = $1;"
+	query := "select o.id, o.name_id, o.object_id, o.action_flags, o.version from roles as o where o.id = $1;"
 	var idTemp uint64
 	var nameIdTemp uint64
 	var objectIdTemp uint64
 	var actionFlagsTemp uint8
-	err := pool.QueryRowContext(ctx, query, id).Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp)
-	return MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp), err
+	var versionTemp uint64
+	err := pool.QueryRowContext(ctx, query, id).Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
+	return MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp), err
 }
 
 func (o Role) Update(pool ExecerContext, ctx context.Context) error {
-	_, err := updateRole(pool, ctx, o.Id, o.NameId, o.ObjectId, o.ActionFlags)
+	_, err := updateRole(pool, ctx, o.Id, o.NameId, o.ObjectId, o.ActionFlags, o.Version)
 	return err
 }
 
@@ -48,24 +51,24 @@ func (o Role) Delete(pool ExecerContext, ctx context.Context) error {
 	return err
 }
 
-func createRole(pool ExecerContext, ctx context.Context, nameId uint64, objectId uint64, actionFlags uint8) (int64, error) {
+func createRole(pool ExecerContext, ctx context.Context, nameId uint64, objectId uint64, actionFlags uint8, version uint64) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := "insert into roles(name_id, object_id, action_flags) values($1, $2, $3);"
-	result, err := pool.ExecContext(ctx, query, nameId, objectId, actionFlags)
+	query := "insert into roles(name_id, object_id, action_flags, version) values($1, $2, $3, $4);"
+	result, err := pool.ExecContext(ctx, query, nameId, objectId, actionFlags, version)
 	if err != nil {
 		return 0, err
 	}
 	return result.RowsAffected()
 }
 
-func updateRole(pool ExecerContext, ctx context.Context, id uint64, nameId uint64, objectId uint64, actionFlags uint8) (int64, error) {
+func updateRole(pool ExecerContext, ctx context.Context, id uint64, nameId uint64, objectId uint64, actionFlags uint8, version uint64) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := "update roles set name_id = $2, object_id = $3, action_flags = $4 where id = $1;"
-	result, err := pool.ExecContext(ctx, query, id, nameId, objectId, actionFlags)
+	query := "update roles set name_id = $2, object_id = $3, action_flags = $4, version = $5 where id = $1;"
+	result, err := pool.ExecContext(ctx, query, id, nameId, objectId, actionFlags, version)
 	if err != nil {
 		return 0, err
 	}
@@ -88,11 +91,12 @@ func GetRolesByUserId(pool QueryerContext, ctx context.Context, userId uint64) (
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := "select r.id, r.name_id, r.object_id, r.action_flags from roles as r where r.id in (select o.role_id from user_roles as o where o.user_id = $1);"
+	query := "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r where r.id in (select o.role_id from user_roles as o where o.user_id = $1);"
 	var idTemp uint64
 	var nameIdTemp uint64
 	var objectIdTemp uint64
 	var actionFlagsTemp uint8
+	var versionTemp uint64
 	rows, err := pool.QueryContext(ctx, query, userId)
 	if err != nil {
 		return nil, err
@@ -101,11 +105,11 @@ func GetRolesByUserId(pool QueryerContext, ctx context.Context, userId uint64) (
 
 	results := []Role{}
 	for rows.Next() {
-		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp)
+		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
 		if err != nil {
 			return nil, err
 		}
-		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp))
+		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp))
 	}
 	return results, nil
 }
@@ -114,11 +118,12 @@ func GetRolesByObjectIds(pool QueryerContext, ctx context.Context, objectIds []u
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := varArgsFilter("select r.id, r.name_id, r.object_id, r.action_flags from roles as r where r.object_id in ($1);", "$1", len(objectIds))
+	query := varArgsFilter("select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r where r.object_id in ($1);", "$1", len(objectIds))
 	var idTemp uint64
 	var nameIdTemp uint64
 	var objectIdTemp uint64
 	var actionFlagsTemp uint8
+	var versionTemp uint64
 	rows, err := pool.QueryContext(ctx, query, anyConverter(objectIds)...)
 	if err != nil {
 		return nil, err
@@ -127,11 +132,11 @@ func GetRolesByObjectIds(pool QueryerContext, ctx context.Context, objectIds []u
 
 	results := []Role{}
 	for rows.Next() {
-		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp)
+		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
 		if err != nil {
 			return nil, err
 		}
-		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp))
+		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp))
 	}
 	return results, nil
 }
@@ -140,26 +145,28 @@ func GetRoleByNameAndObjectId(pool RowQueryerContext, ctx context.Context, name
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := "select r.id, r.name_id, r.object_id, r.action_flags from roles as r, role_names as n where r.name_id = n.id and n.name = $1 and r.object_id = $2;"
+	query := "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r, role_names as n where r.name_id = n.id and n.name = $1 and r.object_id = $2;"
 	var idTemp uint64
 	var nameIdTemp uint64
 	var objectIdTemp uint64
 	var actionFlagsTemp uint8
-	err := pool.QueryRowContext(ctx, query, name, objectId).Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp)
-	return MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp), err
+	var versionTemp uint64
+	err := pool.QueryRowContext(ctx, query, name, objectId).Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
+	return MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp), err
 }
 
 func GetRoleByNameIdAndObjectId(pool RowQueryerContext, ctx context.Context, nameId uint64, objectId uint64) (Role, error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	query := "select r.id, r.name_id, r.object_id, r.action_flags from roles as r where r.name_id = $1 and r.object_id = $2;"
+	query := "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r where r.name_id = $1 and r.object_id = $2;"
 	var idTemp uint64
 	var nameIdTemp uint64
 	var objectIdTemp uint64
 	var actionFlagsTemp uint8
-	err := pool.QueryRowContext(ctx, query, nameId, objectId).Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp)
-	return MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp), err
+	var versionTemp uint64
+	err := pool.QueryRowContext(ctx, query, nameId, objectId).Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
+	return MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp), err
 }
 
 func GetRolesByNameAndObjectIds(pool QueryerContext, ctx context.Context, name string, objectIds []uint64) ([]Role, error) {
@@ -170,11 +177,12 @@ func GetRolesByNameAndObjectIds(pool QueryerContext, ctx context.Context, name s
 	queryArgs := make([]any, 0, size)
 	queryArgs = append(queryArgs, name)
 	queryArgs = append(queryArgs, anyConverter(objectIds)...)
-	query := varArgsFilter("select r.id, r.name_id, r.object_id, r.action_flags from roles as r, role_names as n where r.name_id = n.id and n.name = $1 and r.object_id in ($2);", "$2", size)
+	query := varArgsFilter("select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r, role_names as n where r.name_id = n.id and n.name = $1 and r.object_id in ($2);", "$2", size)
 	var idTemp uint64
 	var nameIdTemp uint64
 	var objectIdTemp uint64
 	var actionFlagsTemp uint8
+	var versionTemp uint64
 	rows, err := pool.QueryContext(ctx, query, queryArgs...)
 	if err != nil {
 		return nil, err
@@ -183,11 +191,74 @@ func GetRolesByNameAndObjectIds(pool QueryerContext, ctx context.Context, name s
 
 	results := []Role{}
 	for rows.Next() {
-		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp)
+		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp))
+	}
+	return results, nil
+}
+
+func CreateRoleIfAbsent(pool ExecerContext, ctx context.Context, nameId uint64, objectId uint64, actionFlags uint8) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := "insert into roles(name_id, object_id, action_flags, version) values($1, $2, $3, 0) on conflict (name_id, object_id) do nothing;"
+	result, err := pool.ExecContext(ctx, query, nameId, objectId, actionFlags)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func GetAllRoles(pool QueryerContext, ctx context.Context) ([]Role, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r;"
+	var idTemp uint64
+	var nameIdTemp uint64
+	var objectIdTemp uint64
+	var actionFlagsTemp uint8
+	var versionTemp uint64
+	rows, err := pool.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []Role{}
+	for rows.Next() {
+		err := rows.Scan(&idTemp, &nameIdTemp, &objectIdTemp, &actionFlagsTemp, &versionTemp)
 		if err != nil {
 			return nil, err
 		}
-		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp))
+		results = append(results, MakeRole(idTemp, nameIdTemp, objectIdTemp, actionFlagsTemp, versionTemp))
 	}
 	return results, nil
 }
+
+func UpdateRoleActionFlags(pool ExecerContext, ctx context.Context, id uint64, actionFlags uint8, version uint64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := "update roles set action_flags = $2, version = version + 1 where id = $1 and version = $3;"
+	result, err := pool.ExecContext(ctx, query, id, actionFlags, version)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func DeleteRolesByObjectIds(pool ExecerContext, ctx context.Context, objectIds []uint64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := varArgsFilter("delete from roles where object_id in ($1);", "$1", len(objectIds))
+	result, err := pool.ExecContext(ctx, query, anyConverter(objectIds)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -113,6 +113,18 @@ func GetRoleNamesByIds(pool QueryerContext, ctx context.Context, ids []uint64) (
 	return results, nil
 }
 
+func CreateRoleNameIfAbsent(pool ExecerContext, ctx context.Context, name string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := "insert into role_names(name) values($1) on conflict (name) do nothing;"
+	result, err := pool.ExecContext(ctx, query, name)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 func DeleteUnusedRoleNames(pool ExecerContext, ctx context.Context) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
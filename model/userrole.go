@@ -81,6 +81,31 @@ func deleteUserRole(pool ExecerContext, ctx context.Context, id uint64) (int64,
 	return result.RowsAffected()
 }
 
+func GetAllUserRoles(pool QueryerContext, ctx context.Context) ([]UserRole, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := "select u.id, u.user_id, u.role_id from user_roles as u;"
+	var idTemp uint64
+	var userIdTemp uint64
+	var roleIdTemp uint64
+	rows, err := pool.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []UserRole{}
+	for rows.Next() {
+		err := rows.Scan(&idTemp, &userIdTemp, &roleIdTemp)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, MakeUserRole(idTemp, userIdTemp, roleIdTemp))
+	}
+	return results, nil
+}
+
 func DeleteUserRolesByUserId(pool ExecerContext, ctx context.Context, userId uint64) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -92,3 +117,27 @@ func DeleteUserRolesByUserId(pool ExecerContext, ctx context.Context, userId uin
 	}
 	return result.RowsAffected()
 }
+
+func DeleteUserRolesByRoleId(pool ExecerContext, ctx context.Context, roleId uint64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := "delete from user_roles where role_id = $1;"
+	result, err := pool.ExecContext(ctx, query, roleId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func DeleteUserRolesByObjectIds(pool ExecerContext, ctx context.Context, objectIds []uint64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := varArgsFilter("delete from user_roles where role_id in (select r.id from roles as r where r.object_id in ($1));", "$1", len(objectIds))
+	result, err := pool.ExecContext(ctx, query, anyConverter(objectIds)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
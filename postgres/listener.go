@@ -0,0 +1,85 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Listen receives the notifications sent on channel (with pg_notify) until ctx is done,
+// it reconnects when the connection is lost and then calls onReset because notifications could have been missed.
+func Listen(ctx context.Context, dbAddr string, channel string, onNotification func(string), onReset func(), onError func(error)) {
+	delay := minReconnectDelay
+	for first := true; ; first = false {
+		conn, err := listenConn(ctx, dbAddr, channel)
+		if err == nil {
+			delay = minReconnectDelay
+			if !first {
+				onReset()
+			}
+
+			err = waitNotifications(ctx, conn, onNotification)
+			conn.Close(context.Background())
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		onError(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func listenConn(ctx context.Context, dbAddr string, channel string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, dbAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+func waitNotifications(ctx context.Context, conn *pgx.Conn, onNotification func(string)) error {
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		onNotification(notification.Payload)
+	}
+}
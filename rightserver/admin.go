@@ -0,0 +1,443 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+)
+
+// administration operations without RPC in puzzlerightservice, they are called from the command line
+
+const (
+	auditDeleteObjects = "DeleteObjects"
+	auditRenameRole    = "RenameRole"
+	auditCopyObject    = "CopyObjectRights"
+	auditCopyUser      = "CopyUserRights"
+)
+
+var (
+	errUnknownRoleName = errors.New("unknown role name")
+	errRoleNameExists  = errors.New("role name already exists")
+	errSameObject      = errors.New("source and target objects are the same")
+	errSameUser        = errors.New("source and target users are the same")
+)
+
+type DeletedCounts struct {
+	Roles     int64
+	UserRoles int64
+	RoleNames int64
+}
+
+type CopiedCounts struct {
+	Roles     int
+	UserRoles int
+}
+
+// DeleteObjects removes in one transaction all the roles on the objects, their user roles
+// and the role names no longer used (the other instances are notified to invalidate their cache).
+func DeleteObjects(ctx context.Context, store Store, objectIds []uint64) (DeletedCounts, error) {
+	var counts DeletedCounts
+	if len(objectIds) == 0 {
+		return counts, nil
+	}
+
+	err := store.Transaction(ctx, func(tx Store) error {
+		roles, err := tx.GetRolesByObjectIds(ctx, objectIds)
+		if err != nil {
+			return err
+		}
+
+		idToKey, err := loadRoleKeys(ctx, tx, roles)
+		if err != nil {
+			return err
+		}
+
+		if counts.Roles, counts.UserRoles, err = tx.DeleteRolesByObjectIds(ctx, objectIds); err != nil {
+			return err
+		}
+
+		for _, role := range roles {
+			key := idToKey[role.Id]
+			if err = tx.CreateAuditEntry(ctx, auditDeleteObjects, auditRoleKind, 0, key.objectId, key.name, role.ActionFlags, 0); err != nil {
+				return err
+			}
+		}
+
+		if counts.RoleNames, err = tx.DeleteUnusedRoleNames(ctx); err != nil || counts.RoleNames == 0 {
+			return err
+		}
+		return notifyDeletedNames(ctx, tx, roles)
+	})
+	return counts, err
+}
+
+// notify the deletion of the names of the deleted roles which are no longer used (call after DeleteUnusedRoleNames)
+func notifyDeletedNames(ctx context.Context, tx Store, deletedRoles []model.Role) error {
+	nameIdSet := map[uint64]empty{}
+	for _, role := range deletedRoles {
+		nameIdSet[role.NameId] = empty{}
+	}
+	if len(nameIdSet) == 0 {
+		return nil
+	}
+
+	nameIds := make([]uint64, 0, len(nameIdSet))
+	for nameId := range nameIdSet {
+		nameIds = append(nameIds, nameId)
+	}
+	sort.Slice(nameIds, func(i, j int) bool {
+		return nameIds[i] < nameIds[j]
+	})
+
+	remainingNames, err := tx.GetRoleNamesByIds(ctx, nameIds)
+	if err != nil {
+		return err
+	}
+	for _, roleName := range remainingNames {
+		delete(nameIdSet, roleName.Id)
+	}
+
+	for _, nameId := range nameIds {
+		if _, deleted := nameIdSet[nameId]; !deleted {
+			continue
+		}
+		if err = tx.Notify(ctx, changedNamePayload(nameId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameRole renames a role name on every object in one transaction,
+// when newName already exists it fails unless merge is true, then the roles of oldName are merged
+// in the ones of newName on the same object (the actions are combined and the users keep their access).
+func RenameRole(ctx context.Context, store Store, oldName string, newName string, merge bool) error {
+	if oldName == newName {
+		return nil
+	}
+
+	return store.Transaction(ctx, func(tx Store) error {
+		oldRoleName, err := tx.GetRoleNameByName(ctx, oldName)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return errUnknownRoleName
+			}
+			return err
+		}
+
+		allRoles, err := tx.GetAllRoles(ctx)
+		if err != nil {
+			return err
+		}
+
+		newRoleName, err := tx.GetRoleNameByName(ctx, newName)
+		if err == sql.ErrNoRows {
+			if err = tx.UpdateRoleName(ctx, model.MakeRoleName(oldRoleName.Id, newName)); err != nil {
+				return err
+			}
+
+			for _, role := range allRoles {
+				if role.NameId != oldRoleName.Id {
+					continue
+				}
+				if err = auditRename(ctx, tx, role.ObjectId, oldName, newName, role.ActionFlags, 0, role.ActionFlags); err != nil {
+					return err
+				}
+			}
+			return tx.Notify(ctx, changedNamePayload(oldRoleName.Id))
+		}
+		if err != nil {
+			return err
+		}
+		if !merge {
+			return errRoleNameExists
+		}
+
+		return mergeRoles(ctx, tx, allRoles, oldRoleName, newRoleName)
+	})
+}
+
+func mergeRoles(ctx context.Context, tx Store, allRoles []model.Role, oldRoleName model.RoleName, newRoleName model.RoleName) error {
+	objectIdToNewRole := map[uint64]model.Role{}
+	for _, role := range allRoles {
+		if role.NameId == newRoleName.Id {
+			objectIdToNewRole[role.ObjectId] = role
+		}
+	}
+
+	userRoles, err := tx.GetAllUserRoles(ctx)
+	if err != nil {
+		return err
+	}
+
+	roleIdToUserIds := map[uint64][]uint64{}
+	for _, userRole := range userRoles {
+		roleIdToUserIds[userRole.RoleId] = append(roleIdToUserIds[userRole.RoleId], userRole.UserId)
+	}
+
+	for _, oldRole := range allRoles {
+		if oldRole.NameId != oldRoleName.Id {
+			continue
+		}
+
+		newRole, exists := objectIdToNewRole[oldRole.ObjectId]
+		beforeFlags := newRole.ActionFlags
+		afterFlags := beforeFlags | oldRole.ActionFlags
+		if !exists {
+			if _, err = tx.CreateRole(ctx, model.MakeRole(0, newRoleName.Id, oldRole.ObjectId, afterFlags, 0)); err != nil {
+				return err
+			}
+			// must retrieve the id
+			if newRole, err = tx.GetRoleByNameIdAndObjectId(ctx, newRoleName.Id, oldRole.ObjectId); err != nil {
+				return err
+			}
+		} else if afterFlags != beforeFlags {
+			newRole.ActionFlags = afterFlags
+			updated, err := tx.UpdateRole(ctx, newRole)
+			if err != nil {
+				return err
+			}
+			if !updated {
+				return errRoleConflict
+			}
+		}
+
+		newUserIdSet := makeIdSet(roleIdToUserIds[newRole.Id])
+		for _, userId := range roleIdToUserIds[oldRole.Id] {
+			if _, ok := newUserIdSet[userId]; ok {
+				continue
+			}
+			if err = tx.CreateUserRole(ctx, model.MakeUserRole(0, userId, newRole.Id)); err != nil {
+				return err
+			}
+		}
+
+		// the user roles of the old role are deleted with it
+		if err = tx.DeleteRole(ctx, oldRole); err != nil {
+			return err
+		}
+		if err = auditRename(ctx, tx, oldRole.ObjectId, oldRoleName.Name, newRoleName.Name, oldRole.ActionFlags, beforeFlags, afterFlags); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.DeleteUnusedRoleNames(ctx); err != nil {
+		return err
+	}
+	return tx.Notify(ctx, changedNamePayload(oldRoleName.Id))
+}
+
+// the old role loses its actions and the new one gets them
+func auditRename(ctx context.Context, tx Store, objectId uint64, oldName string, newName string, oldFlags uint8, beforeFlags uint8, afterFlags uint8) error {
+	if err := tx.CreateAuditEntry(ctx, auditRenameRole, auditRoleKind, 0, objectId, oldName, oldFlags, 0); err != nil {
+		return err
+	}
+	return tx.CreateAuditEntry(ctx, auditRenameRole, auditRoleKind, 0, objectId, newName, beforeFlags, afterFlags)
+}
+
+// CopyObjectRights copies in one transaction the roles of the source object on the target object
+// (and their user roles when includeUsers is true), a role already on the target with the same name
+// gets the actions of the source role when overwrite is true, else the actions are combined.
+func CopyObjectRights(ctx context.Context, store Store, sourceId uint64, targetId uint64, includeUsers bool, overwrite bool) (CopiedCounts, error) {
+	var counts CopiedCounts
+	if sourceId == targetId {
+		return counts, errSameObject
+	}
+
+	err := store.Transaction(ctx, func(tx Store) error {
+		// f is called again when the transaction is retried
+		counts = CopiedCounts{}
+		roles, err := tx.GetRolesByObjectIds(ctx, []uint64{sourceId, targetId})
+		if err != nil {
+			return err
+		}
+
+		sourceRoles := make([]model.Role, 0, len(roles))
+		nameIdToTargetRole := map[uint64]model.Role{}
+		for _, role := range roles {
+			if role.ObjectId == sourceId {
+				sourceRoles = append(sourceRoles, role)
+			} else {
+				nameIdToTargetRole[role.NameId] = role
+			}
+		}
+
+		idToKey, err := loadRoleKeys(ctx, tx, sourceRoles)
+		if err != nil {
+			return err
+		}
+
+		var roleIdToUserIds map[uint64][]uint64
+		if includeUsers {
+			userRoles, err := tx.GetAllUserRoles(ctx)
+			if err != nil {
+				return err
+			}
+
+			roleIdToUserIds = map[uint64][]uint64{}
+			for _, userRole := range userRoles {
+				roleIdToUserIds[userRole.RoleId] = append(roleIdToUserIds[userRole.RoleId], userRole.UserId)
+			}
+		}
+
+		for _, sourceRole := range sourceRoles {
+			targetRole, exists := nameIdToTargetRole[sourceRole.NameId]
+			beforeFlags := targetRole.ActionFlags
+			afterFlags := sourceRole.ActionFlags
+			if !overwrite {
+				afterFlags |= beforeFlags
+			}
+
+			if !exists {
+				if _, err = tx.CreateRole(ctx, model.MakeRole(0, sourceRole.NameId, targetId, afterFlags, 0)); err != nil {
+					return err
+				}
+				// must retrieve the id
+				if targetRole, err = tx.GetRoleByNameIdAndObjectId(ctx, sourceRole.NameId, targetId); err != nil {
+					return err
+				}
+			} else if afterFlags != beforeFlags {
+				targetRole.ActionFlags = afterFlags
+				updated, err := tx.UpdateRole(ctx, targetRole)
+				if err != nil {
+					return err
+				}
+				if !updated {
+					return errRoleConflict
+				}
+			}
+
+			if afterFlags != beforeFlags {
+				counts.Roles++
+				if err = tx.CreateAuditEntry(ctx, auditCopyObject, auditRoleKind, 0, targetId, idToKey[sourceRole.Id].name, beforeFlags, afterFlags); err != nil {
+					return err
+				}
+			}
+
+			if !includeUsers {
+				continue
+			}
+
+			targetUserIdSet := makeIdSet(roleIdToUserIds[targetRole.Id])
+			for _, userId := range roleIdToUserIds[sourceRole.Id] {
+				if _, ok := targetUserIdSet[userId]; ok {
+					continue
+				}
+				if err = tx.CreateUserRole(ctx, model.MakeUserRole(0, userId, targetRole.Id)); err != nil {
+					return err
+				}
+				if err = tx.CreateAuditEntry(ctx, auditCopyObject, auditUserRoleKind, userId, targetId, idToKey[sourceRole.Id].name, 0, afterFlags); err != nil {
+					return err
+				}
+				counts.UserRoles++
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// CopyUserRights grants in one transaction the roles of the source user to the target user
+// (only the ones on objectIds when it is not empty), the roles of the target are kept,
+// with transfer the copied roles are also removed from the source user,
+// return the number of roles granted to the target.
+func CopyUserRights(ctx context.Context, store Store, sourceUserId uint64, targetUserId uint64, objectIds []uint64, transfer bool) (int, error) {
+	if sourceUserId == targetUserId {
+		return 0, errSameUser
+	}
+
+	granted := 0
+	objectIdSet := makeIdSet(objectIds)
+	err := store.Transaction(ctx, func(tx Store) error {
+		// f is called again when the transaction is retried
+		granted = 0
+		sourceRoles, err := tx.GetRolesByUserId(ctx, sourceUserId)
+		if err != nil {
+			return err
+		}
+
+		targetRoles, err := tx.GetRolesByUserId(ctx, targetUserId)
+		if err != nil {
+			return err
+		}
+
+		copiedRoles := make([]model.Role, 0, len(sourceRoles))
+		keptRoles := make([]model.Role, 0, len(sourceRoles))
+		for _, role := range sourceRoles {
+			if _, ok := objectIdSet[role.ObjectId]; ok || len(objectIdSet) == 0 {
+				copiedRoles = append(copiedRoles, role)
+			} else {
+				keptRoles = append(keptRoles, role)
+			}
+		}
+
+		idToKey, err := loadRoleKeys(ctx, tx, copiedRoles)
+		if err != nil {
+			return err
+		}
+
+		targetRoleIdSet := make(map[uint64]empty, len(targetRoles))
+		for _, role := range targetRoles {
+			targetRoleIdSet[role.Id] = empty{}
+		}
+
+		for _, role := range copiedRoles {
+			if _, ok := targetRoleIdSet[role.Id]; ok {
+				continue
+			}
+			if err = tx.CreateUserRole(ctx, model.MakeUserRole(0, targetUserId, role.Id)); err != nil {
+				return err
+			}
+
+			key := idToKey[role.Id]
+			if err = tx.CreateAuditEntry(ctx, auditCopyUser, auditUserRoleKind, targetUserId, key.objectId, key.name, 0, role.ActionFlags); err != nil {
+				return err
+			}
+			granted++
+		}
+
+		if !transfer || len(copiedRoles) == 0 {
+			return nil
+		}
+
+		// like UpdateUser, the user roles of the source are recreated without the transferred ones
+		if _, err = tx.DeleteUserRolesByUserId(ctx, sourceUserId); err != nil {
+			return err
+		}
+		for _, role := range keptRoles {
+			if err = tx.CreateUserRole(ctx, model.MakeUserRole(0, sourceUserId, role.Id)); err != nil {
+				return err
+			}
+		}
+
+		for _, role := range copiedRoles {
+			key := idToKey[role.Id]
+			if err = tx.CreateAuditEntry(ctx, auditCopyUser, auditUserRoleKind, sourceUserId, key.objectId, key.name, role.ActionFlags, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return granted, err
+}
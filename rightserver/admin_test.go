@@ -0,0 +1,380 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	pb "github.com/dvaumoron/puzzlerightservice"
+)
+
+var errRolledBack = errors.New("rolled back to be retried")
+
+// retryingStore runs each transaction twice, like a store retrying after a conflict, the first run is rolled back
+type retryingStore struct {
+	rightserver.Store
+}
+
+func (s retryingStore) Transaction(ctx context.Context, f func(rightserver.Store) error) error {
+	err := s.Store.Transaction(ctx, func(tx rightserver.Store) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		return errRolledBack
+	})
+	if err != errRolledBack {
+		return err
+	}
+	return s.Store.Transaction(ctx, f)
+}
+
+// notifyRecorder keeps the payloads sent with Notify (by the transactions too)
+type notifyRecorder struct {
+	rightserver.Store
+	payloads *[]string
+}
+
+func (s notifyRecorder) Notify(ctx context.Context, payload string) error {
+	*s.payloads = append(*s.payloads, payload)
+	return nil
+}
+
+func (s notifyRecorder) Transaction(ctx context.Context, f func(rightserver.Store) error) error {
+	return s.Store.Transaction(ctx, func(tx rightserver.Store) error {
+		return f(notifyRecorder{Store: tx, payloads: s.payloads})
+	})
+}
+
+func namePayload(t *testing.T, store rightserver.Store, name string) string {
+	t.Helper()
+	roleName, err := store.GetRoleNameByName(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "name:" + strconv.FormatUint(roleName.Id, 10)
+}
+
+func listRoleKeys(t testing.TB, server pb.RightServer, objectIds ...uint64) []string {
+	t.Helper()
+	roles, err := server.ListRoles(context.Background(), &pb.ObjectIds{Ids: objectIds})
+	if err != nil {
+		t.Fatalf("ListRoles(%v) failed : %v", objectIds, err)
+	}
+	return roleKeys(roles.List)
+}
+
+func userRoleKeys(t testing.TB, server pb.RightServer, userId uint64) []string {
+	t.Helper()
+	roles, err := server.ListUserRoles(context.Background(), &pb.UserId{Id: userId})
+	if err != nil {
+		t.Fatalf("ListUserRoles(%d) failed : %v", userId, err)
+	}
+	return roleKeys(roles.List)
+}
+
+func TestDeleteObjects(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+		mustUpdateRole(t, server, "reader", 5, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "editor", 6, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "admin", 7, pb.RightAction_DELETE)
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5}, &pb.RoleRequest{Name: "editor", ObjectId: 6})
+		mustUpdateUser(t, server, 8, &pb.RoleRequest{Name: "reader", ObjectId: 5})
+
+		// the names only used on the deleted objects
+		expectedPayloads := []string{namePayload(t, store, "reader"), namePayload(t, store, "admin")}
+
+		var payloads []string
+		counts, err := rightserver.DeleteObjects(context.Background(), notifyRecorder{Store: store, payloads: &payloads}, []uint64{5, 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(payloads, expectedPayloads) {
+			t.Errorf("expected notifications %v, got %v", expectedPayloads, payloads)
+		}
+		if expected := (rightserver.DeletedCounts{Roles: 3, UserRoles: 2, RoleNames: 2}); counts != expected {
+			t.Errorf("expected %+v, got %+v", expected, counts)
+		}
+
+		if keys := listRoleKeys(t, server, 5, 6, 7); !equalStrings(keys, []string{roleKey("editor", 6)}) {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+		if keys := userRoleKeys(t, server, 7); !equalStrings(keys, []string{roleKey("editor", 6)}) {
+			t.Errorf("unexpected roles for user 7 : %v", keys)
+		}
+		if keys := userRoleKeys(t, server, 8); len(keys) != 0 {
+			t.Errorf("unexpected roles for user 8 : %v", keys)
+		}
+		// the deleted names can be used again
+		mustUpdateRole(t, server, "reader", 6, pb.RightAction_ACCESS)
+	})
+}
+
+func TestDeleteObjectsEmpty(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS)
+
+		counts, err := rightserver.DeleteObjects(context.Background(), store, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts != (rightserver.DeletedCounts{}) {
+			t.Errorf("unexpected counts : %+v", counts)
+		}
+		if keys := listRoleKeys(t, server, 5); len(keys) != 1 {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+	})
+}
+
+func TestRenameRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "guest", 5, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "guest", 6, pb.RightAction_ACCESS, pb.RightAction_CREATE)
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "guest", ObjectId: 5})
+
+		if err := rightserver.RenameRole(context.Background(), store, "guest", "visitor", false); err != nil {
+			t.Fatal(err)
+		}
+		// the cache of names of the first server has not been notified
+		server = newTestServer(t, store)
+
+		if keys := listRoleKeys(t, server, 5, 6); !equalStrings(keys, []string{roleKey("visitor", 5), roleKey("visitor", 6)}) {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+		if actions := roleActions(t, server, "visitor", 6); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_CREATE) {
+			t.Errorf("unexpected actions : %v", actions)
+		}
+		if keys := userRoleKeys(t, server, 7); !equalStrings(keys, []string{roleKey("visitor", 5)}) {
+			t.Errorf("unexpected roles for user 7 : %v", keys)
+		}
+	})
+}
+
+func TestRenameRoleErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+		mustUpdateRole(t, server, "guest", 5, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "member", 6, pb.RightAction_UPDATE)
+
+		if err := rightserver.RenameRole(ctx, store, "unknown", "visitor", false); err != rightserver.ErrUnknownRoleName {
+			t.Errorf("expected %v, got %v", rightserver.ErrUnknownRoleName, err)
+		}
+		if err := rightserver.RenameRole(ctx, store, "guest", "member", false); err != rightserver.ErrRoleNameExists {
+			t.Errorf("expected %v, got %v", rightserver.ErrRoleNameExists, err)
+		}
+		if err := rightserver.RenameRole(ctx, store, "guest", "guest", false); err != nil {
+			t.Errorf("renaming to the same name failed : %v", err)
+		}
+
+		if keys := listRoleKeys(t, server, 5, 6); !equalStrings(keys, []string{roleKey("guest", 5), roleKey("member", 6)}) {
+			t.Errorf("roles modified by a refused renaming : %v", keys)
+		}
+	})
+}
+
+func TestRenameRoleMerge(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "guest", 5, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "member", 5, pb.RightAction_UPDATE)
+		mustUpdateRole(t, server, "guest", 6, pb.RightAction_ACCESS)
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "guest", ObjectId: 5})
+		mustUpdateUser(t, server, 8, &pb.RoleRequest{Name: "member", ObjectId: 5})
+		mustUpdateUser(t, server, 9, &pb.RoleRequest{Name: "guest", ObjectId: 5}, &pb.RoleRequest{Name: "member", ObjectId: 5}, &pb.RoleRequest{Name: "guest", ObjectId: 6})
+
+		if err := rightserver.RenameRole(context.Background(), store, "guest", "member", true); err != nil {
+			t.Fatal(err)
+		}
+
+		if keys := listRoleKeys(t, server, 5, 6); !equalStrings(keys, []string{roleKey("member", 5), roleKey("member", 6)}) {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+		if actions := roleActions(t, server, "member", 5); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_UPDATE) {
+			t.Errorf("unexpected actions on object 5 : %v", actions)
+		}
+		if actions := roleActions(t, server, "member", 6); !equalActions(actions, pb.RightAction_ACCESS) {
+			t.Errorf("unexpected actions on object 6 : %v", actions)
+		}
+		for userId, expected := range map[uint64][]string{
+			7: {roleKey("member", 5)},
+			8: {roleKey("member", 5)},
+			9: {roleKey("member", 5), roleKey("member", 6)},
+		} {
+			if keys := userRoleKeys(t, server, userId); !equalStrings(keys, expected) {
+				t.Errorf("unexpected roles for user %d : %v", userId, keys)
+			}
+		}
+		// the old name is deleted with its last role
+		if err := rightserver.RenameRole(context.Background(), store, "guest", "other", false); err != rightserver.ErrUnknownRoleName {
+			t.Errorf("expected %v, got %v", rightserver.ErrUnknownRoleName, err)
+		}
+	})
+}
+
+// source 5 : editor (user 7) and reader (user 8), target 6 : reader (user 9)
+func setupCopyObject(t *testing.T, server pb.RightServer) {
+	mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+	mustUpdateRole(t, server, "reader", 5, pb.RightAction_ACCESS)
+	mustUpdateRole(t, server, "reader", 6, pb.RightAction_CREATE)
+	mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5})
+	mustUpdateUser(t, server, 8, &pb.RoleRequest{Name: "reader", ObjectId: 5})
+	mustUpdateUser(t, server, 9, &pb.RoleRequest{Name: "reader", ObjectId: 6})
+}
+
+func TestCopyObjectRights(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		setupCopyObject(t, server)
+
+		counts, err := rightserver.CopyObjectRights(context.Background(), retryingStore{Store: store}, 5, 6, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (rightserver.CopiedCounts{Roles: 2}); counts != expected {
+			t.Errorf("expected %+v, got %+v", expected, counts)
+		}
+
+		if keys := listRoleKeys(t, server, 6); !equalStrings(keys, []string{roleKey("editor", 6), roleKey("reader", 6)}) {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+		if actions := roleActions(t, server, "reader", 6); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_CREATE) {
+			t.Errorf("actions not combined : %v", actions)
+		}
+		if keys := userRoleKeys(t, server, 7); !equalStrings(keys, []string{roleKey("editor", 5)}) {
+			t.Errorf("users copied without includeUsers : %v", keys)
+		}
+	})
+}
+
+func TestCopyObjectRightsUsersOverwrite(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		setupCopyObject(t, server)
+
+		counts, err := rightserver.CopyObjectRights(context.Background(), retryingStore{Store: store}, 5, 6, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (rightserver.CopiedCounts{Roles: 2, UserRoles: 2}); counts != expected {
+			t.Errorf("expected %+v, got %+v", expected, counts)
+		}
+
+		if actions := roleActions(t, server, "reader", 6); !equalActions(actions, pb.RightAction_ACCESS) {
+			t.Errorf("actions not overwritten : %v", actions)
+		}
+		for userId, expected := range map[uint64][]string{
+			7: {roleKey("editor", 5), roleKey("editor", 6)},
+			8: {roleKey("reader", 5), roleKey("reader", 6)},
+			9: {roleKey("reader", 6)},
+		} {
+			if keys := userRoleKeys(t, server, userId); !equalStrings(keys, expected) {
+				t.Errorf("unexpected roles for user %d : %v", userId, keys)
+			}
+		}
+
+		// nothing left to copy
+		if counts, err = rightserver.CopyObjectRights(context.Background(), store, 5, 6, true, true); err != nil {
+			t.Fatal(err)
+		}
+		if counts != (rightserver.CopiedCounts{}) {
+			t.Errorf("unexpected counts of a second copy : %+v", counts)
+		}
+	})
+}
+
+func TestCopyObjectRightsSameObject(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		if _, err := rightserver.CopyObjectRights(context.Background(), store, 5, 5, true, false); err != rightserver.ErrSameObject {
+			t.Errorf("expected %v, got %v", rightserver.ErrSameObject, err)
+		}
+	})
+}
+
+// user 7 : editor on 5 and reader on 6, user 8 : reader on 6
+func setupCopyUser(t *testing.T, server pb.RightServer) {
+	mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+	mustUpdateRole(t, server, "reader", 6, pb.RightAction_ACCESS)
+	mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5}, &pb.RoleRequest{Name: "reader", ObjectId: 6})
+	mustUpdateUser(t, server, 8, &pb.RoleRequest{Name: "reader", ObjectId: 6})
+}
+
+func TestCopyUserRights(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		setupCopyUser(t, server)
+
+		granted, err := rightserver.CopyUserRights(context.Background(), retryingStore{Store: store}, 7, 8, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if granted != 1 {
+			t.Errorf("expected 1 granted role, got %d", granted)
+		}
+
+		expected := []string{roleKey("editor", 5), roleKey("reader", 6)}
+		if keys := userRoleKeys(t, server, 8); !equalStrings(keys, expected) {
+			t.Errorf("unexpected roles for user 8 : %v", keys)
+		}
+		if keys := userRoleKeys(t, server, 7); !equalStrings(keys, expected) {
+			t.Errorf("roles of the source modified without transfer : %v", keys)
+		}
+	})
+}
+
+func TestCopyUserRightsFilterTransfer(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		setupCopyUser(t, server)
+
+		granted, err := rightserver.CopyUserRights(context.Background(), retryingStore{Store: store}, 7, 9, []uint64{6}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if granted != 1 {
+			t.Errorf("expected 1 granted role, got %d", granted)
+		}
+
+		if keys := userRoleKeys(t, server, 9); !equalStrings(keys, []string{roleKey("reader", 6)}) {
+			t.Errorf("unexpected roles for user 9 : %v", keys)
+		}
+		if keys := userRoleKeys(t, server, 7); !equalStrings(keys, []string{roleKey("editor", 5)}) {
+			t.Errorf("unexpected roles left to user 7 : %v", keys)
+		}
+		if keys := userRoleKeys(t, server, 8); !equalStrings(keys, []string{roleKey("reader", 6)}) {
+			t.Errorf("roles of another user modified : %v", keys)
+		}
+	})
+}
+
+func TestCopyUserRightsSameUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		if _, err := rightserver.CopyUserRights(context.Background(), store, 7, 7, nil, true); err != rightserver.ErrSameUser {
+			t.Errorf("expected %v, got %v", rightserver.ErrSameUser, err)
+		}
+	})
+}
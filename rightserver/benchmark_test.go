@@ -0,0 +1,92 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/dvaumoron/puzzlerightservice"
+)
+
+// compare the stores of the tests (including Postgres with database/sql and with pgx when RIGHTSERVER_TEST_POSTGRES is set)
+func forEachStoreBenchmark(b *testing.B, bench func(b *testing.B, server pb.RightServer)) {
+	for _, factory := range storeFactories {
+		factory := factory
+		b.Run(factory.name, func(b *testing.B) {
+			server := newTestServer(b, factory.newStore(b))
+			mustUpdateRole(b, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+			mustUpdateRole(b, server, "reader", 5, pb.RightAction_ACCESS)
+			mustUpdateUser(b, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5})
+			b.ResetTimer()
+			bench(b, server)
+		})
+	}
+}
+
+func BenchmarkAuthQuery(b *testing.B) {
+	forEachStoreBenchmark(b, func(b *testing.B, server pb.RightServer) {
+		ctx := context.Background()
+		request := &pb.RightRequest{UserId: 7, ObjectId: 5, Action: pb.RightAction_UPDATE}
+		for i := 0; i < b.N; i++ {
+			if _, err := server.AuthQuery(ctx, request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkListUserRoles(b *testing.B) {
+	forEachStoreBenchmark(b, func(b *testing.B, server pb.RightServer) {
+		ctx := context.Background()
+		request := &pb.UserId{Id: 7}
+		for i := 0; i < b.N; i++ {
+			if _, err := server.ListUserRoles(ctx, request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// alternate the roles, so each call writes
+func BenchmarkUpdateUser(b *testing.B) {
+	forEachStoreBenchmark(b, func(b *testing.B, server pb.RightServer) {
+		ctx := context.Background()
+		names := []string{"editor", "reader"}
+		for i := 0; i < b.N; i++ {
+			request := &pb.UserRight{UserId: 7, List: []*pb.RoleRequest{{Name: names[i%2], ObjectId: 5}}}
+			if _, err := server.UpdateUser(ctx, request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// alternate the flags, so each call writes
+func BenchmarkUpdateRole(b *testing.B) {
+	forEachStoreBenchmark(b, func(b *testing.B, server pb.RightServer) {
+		ctx := context.Background()
+		actions := [][]pb.RightAction{{pb.RightAction_ACCESS}, {pb.RightAction_ACCESS, pb.RightAction_CREATE}}
+		for i := 0; i < b.N; i++ {
+			if _, err := server.UpdateRole(ctx, &pb.Role{Name: "reader", ObjectId: 5, List: actions[i%2]}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
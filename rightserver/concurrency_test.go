@@ -0,0 +1,237 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	pb "github.com/dvaumoron/puzzlerightservice"
+)
+
+const concurrentCalls = 20
+
+// run call concurrently and return the errors
+func runConcurrently(call func(index int) error) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, concurrentCalls)
+	start := make(chan struct{})
+	for index := 0; index < concurrentCalls; index++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			<-start
+			errs[index] = call(index)
+		}(index)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+func checkNoError(t *testing.T, errs []error) {
+	t.Helper()
+	for index, err := range errs {
+		if err != nil {
+			t.Errorf("call %d failed : %v", index, err)
+		}
+	}
+}
+
+// identical calls creating the same new role name and role must all succeed without duplicates
+func TestUpdateRoleConcurrentCreation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+
+		checkNoError(t, runConcurrently(func(int) error {
+			_, err := server.UpdateRole(ctx, &pb.Role{Name: "editor", ObjectId: 5, List: []pb.RightAction{pb.RightAction_UPDATE}})
+			return err
+		}))
+
+		roles, err := server.ListRoles(ctx, &pb.ObjectIds{Ids: []uint64{5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := roleKeys(roles.List); !equalStrings(keys, []string{roleKey("editor", 5)}) {
+			t.Errorf("expected one role, got %v", keys)
+		}
+		if actions := roleActions(t, server, "editor", 5); !equalActions(actions, pb.RightAction_UPDATE) {
+			t.Errorf("unexpected actions : %v", actions)
+		}
+	})
+}
+
+// identical calls updating the same existing role must all succeed (a version conflict is retried)
+func TestUpdateRoleConcurrentUpdate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS)
+
+		checkNoError(t, runConcurrently(func(int) error {
+			_, err := server.UpdateRole(ctx, &pb.Role{
+				Name: "editor", ObjectId: 5, List: []pb.RightAction{pb.RightAction_ACCESS, pb.RightAction_UPDATE},
+			})
+			return err
+		}))
+
+		if actions := roleActions(t, server, "editor", 5); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_UPDATE) {
+			t.Errorf("unexpected actions : %v", actions)
+		}
+	})
+}
+
+// different names on the same object, each call creates its own role
+func TestUpdateRoleConcurrentNames(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+
+		names := make([]string, concurrentCalls)
+		for index := range names {
+			names[index] = "role" + strconv.Itoa(index)
+		}
+		checkNoError(t, runConcurrently(func(index int) error {
+			_, err := server.UpdateRole(ctx, &pb.Role{Name: names[index], ObjectId: 5, List: []pb.RightAction{pb.RightAction_ACCESS}})
+			return err
+		}))
+
+		roles, err := server.ListRoles(ctx, &pb.ObjectIds{Ids: []uint64{5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roles.List) != concurrentCalls {
+			t.Errorf("expected %d roles, got %v", concurrentCalls, roleKeys(roles.List))
+		}
+	})
+}
+
+// the creations can read the name just before a deletion removes it with its last role
+func TestUpdateRoleConcurrentCreateDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+
+		for round := 0; round < 5; round++ {
+			checkNoError(t, runConcurrently(func(index int) error {
+				var actions []pb.RightAction
+				if index%2 == 0 {
+					actions = []pb.RightAction{pb.RightAction_ACCESS}
+				}
+				_, err := server.UpdateRole(ctx, &pb.Role{Name: "editor", ObjectId: 5, List: actions})
+				return err
+			}))
+
+			roles, err := server.ListRoles(ctx, &pb.ObjectIds{Ids: []uint64{5}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			actions := roleActions(t, server, "editor", 5)
+			switch keys := roleKeys(roles.List); {
+			case len(keys) == 0:
+				if len(actions) != 0 {
+					t.Errorf("actions without role : %v", actions)
+				}
+			case equalStrings(keys, []string{roleKey("editor", 5)}):
+				if !equalActions(actions, pb.RightAction_ACCESS) {
+					t.Errorf("unexpected actions : %v", actions)
+				}
+			default:
+				t.Errorf("unexpected roles : %v", keys)
+			}
+		}
+	})
+}
+
+// like several instances starting together with the same rights configuration
+func TestImportSnapshotConcurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+		snapshot := rightserver.Snapshot{
+			Version: rightserver.SnapshotVersion,
+			Roles: []rightserver.SnapshotRole{
+				{Name: "editor", ObjectId: 5, Actions: []string{"ACCESS", "UPDATE"}},
+				{Name: "reader", ObjectId: 5, Actions: []string{"ACCESS"}},
+			},
+			Users: []rightserver.SnapshotUser{{UserId: 7, Roles: []rightserver.SnapshotRoleRef{{Name: "editor", ObjectId: 5}}}},
+		}
+
+		checkNoError(t, runConcurrently(func(int) error {
+			_, err := rightserver.ImportSnapshot(ctx, store, snapshot, rightserver.ReconcileImport, false)
+			return err
+		}))
+
+		roles, err := server.ListRoles(ctx, &pb.ObjectIds{Ids: []uint64{5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := roleKeys(roles.List); !equalStrings(keys, []string{roleKey("editor", 5), roleKey("reader", 5)}) {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+		if !allowed(t, server, 7, 5, pb.RightAction_UPDATE) {
+			t.Error("imported user role missing")
+		}
+	})
+}
+
+// racingStore creates each role (with no action) just before its caller, like a concurrent transaction would
+type racingStore struct {
+	rightserver.Store
+}
+
+func (s racingStore) CreateRole(ctx context.Context, role model.Role) (bool, error) {
+	racingRole := role
+	racingRole.ActionFlags = 0
+	if _, err := s.Store.CreateRole(ctx, racingRole); err != nil {
+		return false, err
+	}
+	return s.Store.CreateRole(ctx, role)
+}
+
+func (s racingStore) Transaction(ctx context.Context, f func(rightserver.Store) error) error {
+	return s.Store.Transaction(ctx, func(tx rightserver.Store) error {
+		return f(racingStore{Store: tx})
+	})
+}
+
+func TestImportSnapshotRoleCreatedConcurrently(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		snapshot := rightserver.Snapshot{
+			Version: rightserver.SnapshotVersion,
+			Roles:   []rightserver.SnapshotRole{{Name: "editor", ObjectId: 5, Actions: []string{"ACCESS", "UPDATE"}}},
+		}
+
+		changes, err := rightserver.ImportSnapshot(context.Background(), racingStore{Store: store}, snapshot, rightserver.MergeImport, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || changes[0].Kind != rightserver.UpdateRoleChange {
+			t.Errorf("expected the update of the concurrent role, got %v", changes)
+		}
+		if actions := roleActions(t, newTestServer(t, store), "editor", 5); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_UPDATE) {
+			t.Errorf("unexpected actions : %v", actions)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"sync"
+)
+
+// Managed keeps track of the roles and users defined in the rights configuration,
+// their updates through the RPCs are rejected or only logged (they will be overwritten by the next reconciliation).
+type Managed struct {
+	reject   bool
+	mutex    sync.RWMutex
+	roleKeys map[roleKey]empty
+	userIds  map[uint64]empty
+}
+
+func NewManaged(reject bool) *Managed {
+	return &Managed{reject: reject, roleKeys: map[roleKey]empty{}, userIds: map[uint64]empty{}}
+}
+
+// Reconcile applies snapshot (with ReconcileImport) and marks its roles and users as managed,
+// the returned changes are the drift between the database and snapshot.
+func (m *Managed) Reconcile(ctx context.Context, store Store, snapshot Snapshot) ([]Change, error) {
+	changes, err := ImportSnapshot(ctx, store, snapshot, ReconcileImport, false)
+	if err != nil {
+		return nil, err
+	}
+
+	roleKeys := make(map[roleKey]empty, len(snapshot.Roles))
+	for _, snapshotRole := range snapshot.Roles {
+		roleKeys[roleKey{name: snapshotRole.Name, objectId: snapshotRole.ObjectId}] = empty{}
+	}
+	userIds := make(map[uint64]empty, len(snapshot.Users))
+	for _, snapshotUser := range snapshot.Users {
+		userIds[snapshotUser.UserId] = empty{}
+	}
+
+	m.mutex.Lock()
+	m.roleKeys = roleKeys
+	m.userIds = userIds
+	m.mutex.Unlock()
+	return changes, nil
+}
+
+func (m *Managed) hasRole(name string, objectId uint64) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, ok := m.roleKeys[roleKey{name: name, objectId: objectId}]
+	return ok
+}
+
+func (m *Managed) hasUser(userId uint64) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, ok := m.userIds[userId]
+	return ok
+}
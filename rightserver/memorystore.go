@@ -0,0 +1,453 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+)
+
+var (
+	errMissingRole       = errors.New("user role referencing a missing role")
+	errDuplicateUserRole = errors.New("duplicate user role")
+)
+
+type auditEntry struct {
+	rpc         string
+	kind        string
+	userId      uint64
+	objectId    uint64
+	roleName    string
+	beforeFlags uint8
+	afterFlags  uint8
+	createdAt   time.Time
+}
+
+// records are kept in insertion order, so in id order
+type memoryData struct {
+	lastId           uint64
+	roleNames        []model.RoleName
+	roles            []model.Role
+	userRoles        []model.UserRole
+	userAttributes   []model.UserAttribute
+	objects          []model.Object
+	objectAttributes []model.ObjectAttribute
+	auditEntries     []auditEntry
+}
+
+func (d *memoryData) nextId() uint64 {
+	d.lastId++
+	return d.lastId
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		lastId:           d.lastId,
+		roleNames:        append([]model.RoleName(nil), d.roleNames...),
+		roles:            append([]model.Role(nil), d.roles...),
+		userRoles:        append([]model.UserRole(nil), d.userRoles...),
+		userAttributes:   append([]model.UserAttribute(nil), d.userAttributes...),
+		objects:          append([]model.Object(nil), d.objects...),
+		objectAttributes: append([]model.ObjectAttribute(nil), d.objectAttributes...),
+		auditEntries:     append([]auditEntry(nil), d.auditEntries...),
+	}
+}
+
+func (d *memoryData) roleNameId(name string) (uint64, bool) {
+	for _, roleName := range d.roleNames {
+		if roleName.Name == name {
+			return roleName.Id, true
+		}
+	}
+	return 0, false
+}
+
+func (d *memoryData) filterRoles(keep func(model.Role) bool) []model.Role {
+	resRoles := []model.Role{}
+	for _, role := range d.roles {
+		if keep(role) {
+			resRoles = append(resRoles, role)
+		}
+	}
+	return resRoles
+}
+
+// the roles of the user
+func (d *memoryData) userRoleList(userId uint64) []model.Role {
+	roleIdSet := map[uint64]empty{}
+	for _, userRole := range d.userRoles {
+		if userRole.UserId == userId {
+			roleIdSet[userRole.RoleId] = empty{}
+		}
+	}
+	return d.filterRoles(func(role model.Role) bool {
+		_, ok := roleIdSet[role.Id]
+		return ok
+	})
+}
+
+func (d *memoryData) findRole(match func(model.Role) bool) (model.Role, error) {
+	for _, role := range d.roles {
+		if match(role) {
+			return role, nil
+		}
+	}
+	return model.Role{}, sql.ErrNoRows
+}
+
+// a transaction works on a copy of the data, which replace the original on commit
+type memoryStore struct {
+	mutex sync.RWMutex
+	data  *memoryData
+}
+
+// NewMemoryStore returns an empty Store keeping everything in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{data: &memoryData{}}
+}
+
+func (s *memoryStore) GetRolesByUserId(ctx context.Context, userId uint64) ([]model.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.data.userRoleList(userId), nil
+}
+
+func (s *memoryStore) GetAllRoles(ctx context.Context) ([]model.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]model.Role{}, s.data.roles...), nil
+}
+
+func (s *memoryStore) GetRolesByObjectIds(ctx context.Context, objectIds []uint64) ([]model.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	objectIdSet := makeIdSet(objectIds)
+	return s.data.filterRoles(func(role model.Role) bool {
+		_, ok := objectIdSet[role.ObjectId]
+		return ok
+	}), nil
+}
+
+func (s *memoryStore) GetRoleByNameAndObjectId(ctx context.Context, name string, objectId uint64) (model.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	nameId, ok := s.data.roleNameId(name)
+	if !ok {
+		return model.Role{}, sql.ErrNoRows
+	}
+	return s.data.findRole(func(role model.Role) bool {
+		return role.NameId == nameId && role.ObjectId == objectId
+	})
+}
+
+func (s *memoryStore) GetRoleByNameIdAndObjectId(ctx context.Context, nameId uint64, objectId uint64) (model.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.data.findRole(func(role model.Role) bool {
+		return role.NameId == nameId && role.ObjectId == objectId
+	})
+}
+
+func (s *memoryStore) GetRolesByNamesAndObjectIds(ctx context.Context, nameToObjectIds map[string][]uint64) ([]model.Role, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	nameIdToObjectIdSet := make(map[uint64]map[uint64]empty, len(nameToObjectIds))
+	for name, objectIds := range nameToObjectIds {
+		if nameId, ok := s.data.roleNameId(name); ok {
+			nameIdToObjectIdSet[nameId] = makeIdSet(objectIds)
+		}
+	}
+
+	return s.data.filterRoles(func(role model.Role) bool {
+		_, ok := nameIdToObjectIdSet[role.NameId][role.ObjectId]
+		return ok
+	}), nil
+}
+
+func (s *memoryStore) CreateRole(ctx context.Context, role model.Role) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.data.findRole(func(current model.Role) bool {
+		return current.NameId == role.NameId && current.ObjectId == role.ObjectId
+	}); err == nil {
+		return false, nil
+	}
+
+	role.Id = s.data.nextId()
+	role.Version = 0
+	s.data.roles = append(s.data.roles, role)
+	return true, nil
+}
+
+func (s *memoryStore) UpdateRole(ctx context.Context, role model.Role) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for index, current := range s.data.roles {
+		if current.Id == role.Id && current.Version == role.Version {
+			current.ActionFlags = role.ActionFlags
+			current.Version++
+			s.data.roles[index] = current
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) DeleteRole(ctx context.Context, role model.Role) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.roles = s.data.filterRoles(func(current model.Role) bool {
+		return current.Id != role.Id
+	})
+	userRoles := make([]model.UserRole, 0, len(s.data.userRoles))
+	for _, userRole := range s.data.userRoles {
+		if userRole.RoleId != role.Id {
+			userRoles = append(userRoles, userRole)
+		}
+	}
+	s.data.userRoles = userRoles
+	return nil
+}
+
+func (s *memoryStore) DeleteRolesByObjectIds(ctx context.Context, objectIds []uint64) (int64, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	objectIdSet := makeIdSet(objectIds)
+	deletedIdSet := map[uint64]empty{}
+	roles := make([]model.Role, 0, len(s.data.roles))
+	for _, role := range s.data.roles {
+		if _, ok := objectIdSet[role.ObjectId]; ok {
+			deletedIdSet[role.Id] = empty{}
+		} else {
+			roles = append(roles, role)
+		}
+	}
+	userRoles := make([]model.UserRole, 0, len(s.data.userRoles))
+	for _, userRole := range s.data.userRoles {
+		if _, ok := deletedIdSet[userRole.RoleId]; !ok {
+			userRoles = append(userRoles, userRole)
+		}
+	}
+
+	userRoleCount := len(s.data.userRoles) - len(userRoles)
+	s.data.roles = roles
+	s.data.userRoles = userRoles
+	return int64(len(deletedIdSet)), int64(userRoleCount), nil
+}
+
+func (s *memoryStore) GetRoleNameByName(ctx context.Context, name string) (model.RoleName, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	nameId, ok := s.data.roleNameId(name)
+	if !ok {
+		return model.RoleName{}, sql.ErrNoRows
+	}
+	return model.MakeRoleName(nameId, name), nil
+}
+
+func (s *memoryStore) GetRoleNamesByIds(ctx context.Context, ids []uint64) ([]model.RoleName, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	idSet := makeIdSet(ids)
+	roleNames := []model.RoleName{}
+	for _, roleName := range s.data.roleNames {
+		if _, ok := idSet[roleName.Id]; ok {
+			roleNames = append(roleNames, roleName)
+		}
+	}
+	return roleNames, nil
+}
+
+func (s *memoryStore) CreateRoleName(ctx context.Context, roleName model.RoleName) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.data.roleNameId(roleName.Name); ok {
+		return nil
+	}
+
+	roleName.Id = s.data.nextId()
+	s.data.roleNames = append(s.data.roleNames, roleName)
+	return nil
+}
+
+func (s *memoryStore) UpdateRoleName(ctx context.Context, roleName model.RoleName) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for index, current := range s.data.roleNames {
+		if current.Id == roleName.Id {
+			s.data.roleNames[index] = roleName
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteUnusedRoleNames(ctx context.Context) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usedIdSet := map[uint64]empty{}
+	for _, role := range s.data.roles {
+		usedIdSet[role.NameId] = empty{}
+	}
+	roleNames := make([]model.RoleName, 0, len(s.data.roleNames))
+	for _, roleName := range s.data.roleNames {
+		if _, ok := usedIdSet[roleName.Id]; ok {
+			roleNames = append(roleNames, roleName)
+		}
+	}
+	deleted := len(s.data.roleNames) - len(roleNames)
+	s.data.roleNames = roleNames
+	return int64(deleted), nil
+}
+
+func (s *memoryStore) GetAllUserRoles(ctx context.Context) ([]model.UserRole, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]model.UserRole{}, s.data.userRoles...), nil
+}
+
+// same constraints as the schema (existing role and unique user and role pair)
+func (s *memoryStore) CreateUserRole(ctx context.Context, userRole model.UserRole) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.data.findRole(func(role model.Role) bool {
+		return role.Id == userRole.RoleId
+	}); err != nil {
+		return errMissingRole
+	}
+	for _, current := range s.data.userRoles {
+		if current.UserId == userRole.UserId && current.RoleId == userRole.RoleId {
+			return errDuplicateUserRole
+		}
+	}
+
+	userRole.Id = s.data.nextId()
+	s.data.userRoles = append(s.data.userRoles, userRole)
+	return nil
+}
+
+func (s *memoryStore) DeleteUserRolesByUserId(ctx context.Context, userId uint64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	userRoles := make([]model.UserRole, 0, len(s.data.userRoles))
+	for _, userRole := range s.data.userRoles {
+		if userRole.UserId != userId {
+			userRoles = append(userRoles, userRole)
+		}
+	}
+	deleted := len(s.data.userRoles) - len(userRoles)
+	s.data.userRoles = userRoles
+	return int64(deleted), nil
+}
+
+// read under one lock, like the single connection of the other stores
+func (s *memoryStore) GetAuthData(ctx context.Context, userId uint64, objectId uint64) (AuthData, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data := AuthData{Roles: s.data.userRoleList(userId), UserAttributes: []model.UserAttribute{}}
+	for _, attribute := range s.data.userAttributes {
+		if attribute.UserId == userId {
+			data.UserAttributes = append(data.UserAttributes, attribute)
+		}
+	}
+
+	for _, object := range s.data.objects {
+		if object.ObjectId == objectId {
+			data.ObjectFound = true
+			data.Object = object
+			break
+		}
+	}
+	if !data.ObjectFound {
+		return data, nil
+	}
+
+	data.ObjectAttributes = []model.ObjectAttribute{}
+	for _, attribute := range s.data.objectAttributes {
+		if attribute.ObjectId == objectId {
+			data.ObjectAttributes = append(data.ObjectAttributes, attribute)
+		}
+	}
+	return data, nil
+}
+
+func (s *memoryStore) CreateAuditEntry(ctx context.Context, rpc string, kind string, userId uint64, objectId uint64, roleName string, beforeFlags uint8, afterFlags uint8) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.auditEntries = append(s.data.auditEntries, auditEntry{
+		rpc: rpc, kind: kind, userId: userId, objectId: objectId, roleName: roleName,
+		beforeFlags: beforeFlags, afterFlags: afterFlags, createdAt: time.Now(),
+	})
+	return nil
+}
+
+// not shared with other instances
+func (s *memoryStore) Notify(ctx context.Context, payload string) error {
+	return nil
+}
+
+// transactions are serialized, the store is locked until the end of f
+func (s *memoryStore) Transaction(ctx context.Context, f func(Store) error) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	txStore := &memoryStore{data: s.data.clone()}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered in transaction : %v", r)
+		} else if err == nil {
+			s.data = txStore.data
+		}
+	}()
+
+	return f(txStore)
+}
+
+func makeIdSet(ids []uint64) map[uint64]empty {
+	idSet := make(map[uint64]empty, len(ids))
+	for _, id := range ids {
+		idSet[id] = empty{}
+	}
+	return idSet
+}
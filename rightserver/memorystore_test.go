@@ -0,0 +1,149 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+)
+
+func init() {
+	storeFactories = append(storeFactories, storeFactory{name: "memory", newStore: func(testing.TB) rightserver.Store {
+		return rightserver.NewMemoryStore()
+	}})
+}
+
+// create a role with a new name and return it with its id
+func createTestRole(t testing.TB, store rightserver.Store, name string, objectId uint64) model.Role {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.CreateRoleName(ctx, model.MakeRoleName(0, name)); err != nil {
+		t.Fatal(err)
+	}
+	roleName, err := store.GetRoleNameByName(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CreateRole(ctx, model.MakeRole(0, roleName.Id, objectId, 1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	role, err := store.GetRoleByNameIdAndObjectId(ctx, roleName.Id, objectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return role
+}
+
+func TestMemoryStoreUserRoleConstraints(t *testing.T) {
+	store := rightserver.NewMemoryStore()
+	ctx := context.Background()
+	role := createTestRole(t, store, "editor", 5)
+
+	if err := store.CreateUserRole(ctx, model.MakeUserRole(0, 7, role.Id)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUserRole(ctx, model.MakeUserRole(0, 7, role.Id)); err == nil {
+		t.Error("duplicate user role accepted")
+	}
+	if err := store.CreateUserRole(ctx, model.MakeUserRole(0, 7, role.Id+1)); err == nil {
+		t.Error("user role with unknown role accepted")
+	}
+
+	userRoles, err := store.GetAllUserRoles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userRoles) != 1 {
+		t.Errorf("expected 1 user role, got %d", len(userRoles))
+	}
+}
+
+func TestMemoryStoreDeleteRoleCascade(t *testing.T) {
+	store := rightserver.NewMemoryStore()
+	ctx := context.Background()
+	role := createTestRole(t, store, "editor", 5)
+	if err := store.CreateUserRole(ctx, model.MakeUserRole(0, 7, role.Id)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteRole(ctx, role); err != nil {
+		t.Fatal(err)
+	}
+	userRoles, err := store.GetAllUserRoles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userRoles) != 0 {
+		t.Errorf("user roles of deleted role kept : %v", userRoles)
+	}
+}
+
+func TestMemoryStoreTransactionRollback(t *testing.T) {
+	store := rightserver.NewMemoryStore()
+	ctx := context.Background()
+	errTest := errors.New("test error")
+
+	err := store.Transaction(ctx, func(tx rightserver.Store) error {
+		createTestRole(t, tx, "editor", 5)
+		return errTest
+	})
+	if err != errTest {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+
+	err = store.Transaction(ctx, func(tx rightserver.Store) error {
+		createTestRole(t, tx, "viewer", 5)
+		panic("test panic")
+	})
+	if err == nil {
+		t.Fatal("panic in transaction not reported")
+	}
+
+	roles, err := store.GetAllRoles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 0 {
+		t.Errorf("roles of rolled back transactions kept : %v", roles)
+	}
+}
+
+func TestMemoryStoreTransactionCommit(t *testing.T) {
+	store := rightserver.NewMemoryStore()
+	ctx := context.Background()
+
+	if err := store.Transaction(ctx, func(tx rightserver.Store) error {
+		createTestRole(t, tx, "editor", 5)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	role, err := store.GetRoleByNameAndObjectId(ctx, "editor", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role.ObjectId != 5 || role.ActionFlags != 1 {
+		t.Errorf("unexpected committed role : %v", role)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// notification payload for a deleted or renamed role name, followed by its id
+	changedNamePrefix = "name:"
+	// notification payload when the names to invalidate are not known
+	flushPayload = "flush"
+)
+
+// NameCache keeps the role names by id, it can be updated with the notifications of other instances.
+type NameCache struct {
+	mutex    sync.RWMutex
+	idToName map[uint64]string
+}
+
+func NewNameCache() *NameCache {
+	return &NameCache{idToName: map[uint64]string{}}
+}
+
+func (c *NameCache) Invalidate(nameIds ...uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, nameId := range nameIds {
+		delete(c.idToName, nameId)
+	}
+}
+
+func (c *NameCache) Flush() {
+	c.mutex.Lock()
+	c.idToName = map[uint64]string{}
+	c.mutex.Unlock()
+}
+
+// HandleNotification invalidates the entries concerned by payload (sent with Store.Notify),
+// an unknown payload flush the whole cache.
+func (c *NameCache) HandleNotification(payload string) {
+	if strings.HasPrefix(payload, changedNamePrefix) {
+		if nameId, err := strconv.ParseUint(strings.TrimPrefix(payload, changedNamePrefix), 10, 64); err == nil {
+			c.Invalidate(nameId)
+			return
+		}
+	}
+	c.Flush()
+}
+
+func changedNamePayload(nameId uint64) string {
+	return changedNamePrefix + strconv.FormatUint(nameId, 10)
+}
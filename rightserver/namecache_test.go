@@ -0,0 +1,65 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNameCacheHandleNotification(t *testing.T) {
+	for _, test := range []struct {
+		payload  string
+		expected map[uint64]string
+	}{
+		{payload: "name:1", expected: map[uint64]string{2: "reader"}},
+		{payload: changedNamePayload(2), expected: map[uint64]string{1: "editor"}},
+		{payload: "name:3", expected: map[uint64]string{1: "editor", 2: "reader"}},
+		{payload: flushPayload, expected: map[uint64]string{}},
+		{payload: "name:", expected: map[uint64]string{}},
+		{payload: "name:x", expected: map[uint64]string{}},
+		{payload: "unknown", expected: map[uint64]string{}},
+		{payload: "", expected: map[uint64]string{}},
+	} {
+		names := NewNameCache()
+		names.idToName[1] = "editor"
+		names.idToName[2] = "reader"
+
+		names.HandleNotification(test.payload)
+		if !reflect.DeepEqual(names.idToName, test.expected) {
+			t.Errorf("after %q, expected %v, got %v", test.payload, test.expected, names.idToName)
+		}
+	}
+}
+
+func TestNameCacheFlush(t *testing.T) {
+	names := NewNameCache()
+	names.idToName[1] = "editor"
+
+	names.Flush()
+	if len(names.idToName) != 0 {
+		t.Errorf("unexpected names after Flush : %v", names.idToName)
+	}
+	// still usable
+	names.idToName[2] = "reader"
+	names.Invalidate(2, 3)
+	if len(names.idToName) != 0 {
+		t.Errorf("unexpected names after Invalidate : %v", names.idToName)
+	}
+}
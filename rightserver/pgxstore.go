@@ -0,0 +1,368 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// names of the statements prepared on each connection of the pool
+const (
+	getAllRolesStmt                   = "getAllRoles"
+	getRolesByUserIdStmt              = "getRolesByUserId"
+	getRolesByObjectIdsStmt           = "getRolesByObjectIds"
+	getRoleByNameAndObjectIdStmt      = "getRoleByNameAndObjectId"
+	getRoleByNameIdAndObjectIdStmt    = "getRoleByNameIdAndObjectId"
+	getRolesByNameAndObjectIdsStmt    = "getRolesByNameAndObjectIds"
+	createRoleIfAbsentStmt            = "createRoleIfAbsent"
+	updateRoleActionFlagsStmt         = "updateRoleActionFlags"
+	deleteRoleStmt                    = "deleteRole"
+	deleteUserRolesByRoleIdStmt       = "deleteUserRolesByRoleId"
+	deleteUserRolesByObjectIdsStmt    = "deleteUserRolesByObjectIds"
+	deleteRolesByObjectIdsStmt        = "deleteRolesByObjectIds"
+	getRoleNameByNameStmt             = "getRoleNameByName"
+	getRoleNamesByIdsStmt             = "getRoleNamesByIds"
+	createRoleNameIfAbsentStmt        = "createRoleNameIfAbsent"
+	updateRoleNameStmt                = "updateRoleName"
+	deleteUnusedRoleNamesStmt         = "deleteUnusedRoleNames"
+	getAllUserRolesStmt               = "getAllUserRoles"
+	createUserRoleStmt                = "createUserRole"
+	deleteUserRolesByUserIdStmt       = "deleteUserRolesByUserId"
+	getUserAttributesByUserIdStmt     = "getUserAttributesByUserId"
+	getObjectByObjectIdStmt           = "getObjectByObjectId"
+	getObjectAttributesByObjectIdStmt = "getObjectAttributesByObjectId"
+	createAuditEntryStmt              = "createAuditEntry"
+	notifyStmt                        = "notify"
+)
+
+// same queries as the model package, with array parameters instead of variable size lists
+var pgxStatements = map[string]string{
+	getAllRolesStmt:                   "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r;",
+	getRolesByUserIdStmt:              "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r where r.id in (select o.role_id from user_roles as o where o.user_id = $1);",
+	getRolesByObjectIdsStmt:           "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r where r.object_id = any($1);",
+	getRoleByNameAndObjectIdStmt:      "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r, role_names as n where r.name_id = n.id and n.name = $1 and r.object_id = $2;",
+	getRoleByNameIdAndObjectIdStmt:    "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r where r.name_id = $1 and r.object_id = $2;",
+	getRolesByNameAndObjectIdsStmt:    "select r.id, r.name_id, r.object_id, r.action_flags, r.version from roles as r, role_names as n where r.name_id = n.id and n.name = $1 and r.object_id = any($2);",
+	createRoleIfAbsentStmt:            "insert into roles(name_id, object_id, action_flags, version) values($1, $2, $3, 0) on conflict (name_id, object_id) do nothing;",
+	updateRoleActionFlagsStmt:         "update roles set action_flags = $2, version = version + 1 where id = $1 and version = $3;",
+	deleteRoleStmt:                    "delete from roles where id = $1;",
+	deleteUserRolesByRoleIdStmt:       "delete from user_roles where role_id = $1;",
+	deleteUserRolesByObjectIdsStmt:    "delete from user_roles where role_id in (select r.id from roles as r where r.object_id = any($1));",
+	deleteRolesByObjectIdsStmt:        "delete from roles where object_id = any($1);",
+	getRoleNameByNameStmt:             "select n.id, n.name from role_names as n where n.name = $1;",
+	getRoleNamesByIdsStmt:             "select n.id, n.name from role_names as n where n.id = any($1);",
+	createRoleNameIfAbsentStmt:        "insert into role_names(name) values($1) on conflict (name) do nothing;",
+	updateRoleNameStmt:                "update role_names set name = $2 where id = $1;",
+	deleteUnusedRoleNamesStmt:         "delete from role_names where id not in (select distinct(name_id) from roles);",
+	getAllUserRolesStmt:               "select u.id, u.user_id, u.role_id from user_roles as u;",
+	createUserRoleStmt:                "insert into user_roles(user_id, role_id) values($1, $2);",
+	deleteUserRolesByUserIdStmt:       "delete from user_roles where user_id = $1;",
+	getUserAttributesByUserIdStmt:     "select a.id, a.user_id, a.name, a.value from user_attributes as a where a.user_id = $1;",
+	getObjectByObjectIdStmt:           "select o.id, o.object_id, o.object_type, o.name from objects as o where o.object_id = $1;",
+	getObjectAttributesByObjectIdStmt: "select a.id, a.object_id, a.name, a.value from object_attributes as a where a.object_id = $1;",
+	createAuditEntryStmt:              "insert into audit_entries(rpc, kind, user_id, object_id, role_name, before_flags, after_flags, created_at) values($1, $2, $3, $4, $5, $6, $7, current_timestamp);",
+	notifyStmt:                        notifyQuery,
+}
+
+// common part of *pgxpool.Pool and pgx.Tx
+type pgxPool interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults
+}
+
+type pgxStore struct {
+	db            *pgxpool.Pool
+	pool          pgxPool
+	retryable     func(error) bool
+	txOptions     pgx.TxOptions
+	notifyChannel string
+	conflict      *bool // not nil inside a transaction
+}
+
+// PrepareStatements prepares the statements used by the store returned by NewPgxStore,
+// it must be called on each new connection of the pool (with pgxpool.Config.AfterConnect).
+func PrepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, query := range pgxStatements {
+		if _, err := conn.Prepare(ctx, name, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPgxStore returns a Store using directly a pgx pool with prepared statements,
+// retryable, isolation and notifyChannel have the same meaning as in NewSQLStore.
+func NewPgxStore(db *pgxpool.Pool, retryable func(error) bool, isolation sql.IsolationLevel, notifyChannel string) Store {
+	return pgxStore{
+		db: db, pool: db, retryable: retryable, txOptions: pgx.TxOptions{IsoLevel: convertIsolationLevel(isolation)},
+		notifyChannel: notifyChannel,
+	}
+}
+
+func (s pgxStore) GetAllRoles(ctx context.Context) ([]model.Role, error) {
+	return collectRows[model.Role](s, ctx, getAllRolesStmt)
+}
+
+func (s pgxStore) GetRolesByUserId(ctx context.Context, userId uint64) ([]model.Role, error) {
+	return collectRows[model.Role](s, ctx, getRolesByUserIdStmt, userId)
+}
+
+func (s pgxStore) GetRolesByObjectIds(ctx context.Context, objectIds []uint64) ([]model.Role, error) {
+	return collectRows[model.Role](s, ctx, getRolesByObjectIdsStmt, objectIds)
+}
+
+func (s pgxStore) GetRoleByNameAndObjectId(ctx context.Context, name string, objectId uint64) (model.Role, error) {
+	return collectOneRow[model.Role](s, ctx, getRoleByNameAndObjectIdStmt, name, objectId)
+}
+
+func (s pgxStore) GetRoleByNameIdAndObjectId(ctx context.Context, nameId uint64, objectId uint64) (model.Role, error) {
+	return collectOneRow[model.Role](s, ctx, getRoleByNameIdAndObjectIdStmt, nameId, objectId)
+}
+
+// send all the queries in one round trip
+func (s pgxStore) GetRolesByNamesAndObjectIds(ctx context.Context, nameToObjectIds map[string][]uint64) ([]model.Role, error) {
+	resRoles := []model.Role{}
+	batch := &pgx.Batch{}
+	for name, objectIds := range nameToObjectIds {
+		batch.Queue(getRolesByNameAndObjectIdsStmt, name, objectIds).Query(func(rows pgx.Rows) error {
+			roles, err := pgx.CollectRows(rows, pgx.RowToStructByPos[model.Role])
+			resRoles = append(resRoles, roles...)
+			return err
+		})
+	}
+
+	if err := s.check(s.pool.SendBatch(ctx, batch).Close()); err != nil {
+		return nil, err
+	}
+	return resRoles, nil
+}
+
+func (s pgxStore) CreateRole(ctx context.Context, role model.Role) (bool, error) {
+	created, err := s.exec(ctx, createRoleIfAbsentStmt, role.NameId, role.ObjectId, role.ActionFlags)
+	return created != 0, err
+}
+
+func (s pgxStore) UpdateRole(ctx context.Context, role model.Role) (bool, error) {
+	updated, err := s.exec(ctx, updateRoleActionFlagsStmt, role.Id, role.ActionFlags, role.Version)
+	if err == nil && updated == 0 && s.conflict != nil {
+		// the role was modified since it was read, the transaction will read it again
+		*s.conflict = true
+	}
+	return updated != 0, err
+}
+
+// the user roles are deleted explicitly, the schema may not cascade (hand-written before the migrations)
+func (s pgxStore) DeleteRole(ctx context.Context, role model.Role) error {
+	if _, err := s.exec(ctx, deleteUserRolesByRoleIdStmt, role.Id); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, deleteRoleStmt, role.Id)
+	return err
+}
+
+// the user roles are deleted first to count them
+func (s pgxStore) DeleteRolesByObjectIds(ctx context.Context, objectIds []uint64) (int64, int64, error) {
+	userRoleCount, err := s.exec(ctx, deleteUserRolesByObjectIdsStmt, objectIds)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	roleCount, err := s.exec(ctx, deleteRolesByObjectIdsStmt, objectIds)
+	return roleCount, userRoleCount, err
+}
+
+func (s pgxStore) GetRoleNameByName(ctx context.Context, name string) (model.RoleName, error) {
+	return collectOneRow[model.RoleName](s, ctx, getRoleNameByNameStmt, name)
+}
+
+func (s pgxStore) GetRoleNamesByIds(ctx context.Context, ids []uint64) ([]model.RoleName, error) {
+	return collectRows[model.RoleName](s, ctx, getRoleNamesByIdsStmt, ids)
+}
+
+func (s pgxStore) CreateRoleName(ctx context.Context, roleName model.RoleName) error {
+	_, err := s.exec(ctx, createRoleNameIfAbsentStmt, roleName.Name)
+	return err
+}
+
+func (s pgxStore) UpdateRoleName(ctx context.Context, roleName model.RoleName) error {
+	_, err := s.exec(ctx, updateRoleNameStmt, roleName.Id, roleName.Name)
+	return err
+}
+
+func (s pgxStore) DeleteUnusedRoleNames(ctx context.Context) (int64, error) {
+	return s.exec(ctx, deleteUnusedRoleNamesStmt)
+}
+
+func (s pgxStore) GetAllUserRoles(ctx context.Context) ([]model.UserRole, error) {
+	return collectRows[model.UserRole](s, ctx, getAllUserRolesStmt)
+}
+
+func (s pgxStore) CreateUserRole(ctx context.Context, userRole model.UserRole) error {
+	_, err := s.exec(ctx, createUserRoleStmt, userRole.UserId, userRole.RoleId)
+	return err
+}
+
+func (s pgxStore) DeleteUserRolesByUserId(ctx context.Context, userId uint64) (int64, error) {
+	return s.exec(ctx, deleteUserRolesByUserIdStmt, userId)
+}
+
+// send the queries in one batch (so on one connection and in one round trip)
+func (s pgxStore) GetAuthData(ctx context.Context, userId uint64, objectId uint64) (AuthData, error) {
+	var data AuthData
+	batch := &pgx.Batch{}
+	batch.Queue(getRolesByUserIdStmt, userId).Query(func(rows pgx.Rows) (err error) {
+		data.Roles, err = pgx.CollectRows(rows, pgx.RowToStructByPos[model.Role])
+		return err
+	})
+	batch.Queue(getUserAttributesByUserIdStmt, userId).Query(func(rows pgx.Rows) (err error) {
+		data.UserAttributes, err = pgx.CollectRows(rows, pgx.RowToStructByPos[model.UserAttribute])
+		return err
+	})
+	batch.Queue(getObjectByObjectIdStmt, objectId).Query(func(rows pgx.Rows) error {
+		objects, err := pgx.CollectRows(rows, pgx.RowToStructByPos[model.Object])
+		if len(objects) != 0 {
+			data.ObjectFound = true
+			data.Object = objects[0]
+		}
+		return err
+	})
+	// empty when the object is not registered
+	batch.Queue(getObjectAttributesByObjectIdStmt, objectId).Query(func(rows pgx.Rows) (err error) {
+		data.ObjectAttributes, err = pgx.CollectRows(rows, pgx.RowToStructByPos[model.ObjectAttribute])
+		return err
+	})
+
+	return data, s.check(s.pool.SendBatch(ctx, batch).Close())
+}
+
+func (s pgxStore) CreateAuditEntry(ctx context.Context, rpc string, kind string, userId uint64, objectId uint64, roleName string, beforeFlags uint8, afterFlags uint8) error {
+	_, err := s.exec(ctx, createAuditEntryStmt, rpc, kind, userId, objectId, roleName, beforeFlags, afterFlags)
+	return err
+}
+
+func (s pgxStore) Notify(ctx context.Context, payload string) error {
+	if s.notifyChannel == "" {
+		return nil
+	}
+
+	_, err := s.exec(ctx, notifyStmt, s.notifyChannel, payload)
+	return err
+}
+
+func (s pgxStore) Transaction(ctx context.Context, f func(Store) error) (err error) {
+	if s.conflict != nil {
+		return f(s)
+	}
+
+	for attempt := 1; ; attempt++ {
+		var conflict bool
+		err = s.runTransaction(ctx, f, &conflict)
+		if err == nil || !conflict || attempt == maxTxAttempts {
+			return err
+		}
+	}
+}
+
+func (s pgxStore) runTransaction(ctx context.Context, f func(Store) error, conflict *bool) (err error) {
+	tx, err := s.db.BeginTx(ctx, s.txOptions)
+	if err != nil {
+		return err
+	}
+
+	txStore := pgxStore{
+		db: s.db, pool: tx, retryable: s.retryable, txOptions: s.txOptions, notifyChannel: s.notifyChannel, conflict: conflict,
+	}
+	defer txStore.commitOrRollBack(ctx, tx, &err)
+
+	return f(txStore)
+}
+
+// same behaviour as the one of txPool
+func (s pgxStore) commitOrRollBack(ctx context.Context, tx pgx.Tx, err *error) {
+	if r := recover(); r != nil {
+		tx.Rollback(ctx)
+		*err = fmt.Errorf("recovered in transaction : %v", r)
+	} else if *err == nil {
+		*err = s.check(tx.Commit(ctx))
+	} else {
+		tx.Rollback(ctx)
+	}
+}
+
+func (s pgxStore) exec(ctx context.Context, stmt string, args ...any) (int64, error) {
+	tag, err := s.pool.Exec(ctx, stmt, args...)
+	return tag.RowsAffected(), s.check(err)
+}
+
+// with pgx the errors of a query are mostly reported while reading the rows,
+// so the conflicts are detected on the final error
+func (s pgxStore) check(err error) error {
+	if err != nil && s.conflict != nil && s.retryable(err) {
+		*s.conflict = true
+	}
+	return err
+}
+
+func collectRows[T any](s pgxStore, ctx context.Context, stmt string, args ...any) ([]T, error) {
+	rows, err := s.pool.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, s.check(err)
+	}
+
+	res, err := pgx.CollectRows(rows, pgx.RowToStructByPos[T])
+	return res, s.check(err)
+}
+
+// return sql.ErrNoRows when nothing match, like the other stores
+func collectOneRow[T any](s pgxStore, ctx context.Context, stmt string, args ...any) (T, error) {
+	rows, err := s.pool.Query(ctx, stmt, args...)
+	if err != nil {
+		var zero T
+		return zero, s.check(err)
+	}
+
+	res, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[T])
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = sql.ErrNoRows
+	}
+	return res, s.check(err)
+}
+
+func convertIsolationLevel(isolation sql.IsolationLevel) pgx.TxIsoLevel {
+	switch isolation {
+	case sql.LevelReadUncommitted:
+		return pgx.ReadUncommitted
+	case sql.LevelReadCommitted:
+		return pgx.ReadCommitted
+	case sql.LevelRepeatableRead, sql.LevelSnapshot:
+		return pgx.RepeatableRead
+	case sql.LevelSerializable, sql.LevelLinearizable:
+		return pgx.Serializable
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/migration"
+	"github.com/dvaumoron/puzzlerightserver/postgres"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// the tests and benchmarks run against Postgres only when this variable gives the address of a database,
+// its tables are emptied before each test
+const postgresAddrEnv = "RIGHTSERVER_TEST_POSTGRES"
+
+const truncateQuery = "truncate table audit_entries, user_roles, roles, role_names, user_attributes, object_attributes, objects restart identity;"
+
+func init() {
+	if os.Getenv(postgresAddrEnv) == "" {
+		return
+	}
+
+	storeFactories = append(storeFactories, storeFactory{name: "postgres", newStore: newPostgresStore}, storeFactory{name: "pgx", newStore: newPgxStore})
+}
+
+func newPostgresStore(t testing.TB) rightserver.Store {
+	return rightserver.NewSQLStore(openPostgresDB(t), postgres.IsRetryable, sql.LevelDefault, "")
+}
+
+// the database is migrated and emptied with database/sql, then used with its own pgx pool
+func newPgxStore(t testing.TB) rightserver.Store {
+	openPostgresDB(t)
+
+	ctx := context.Background()
+	config, err := pgxpool.ParseConfig(os.Getenv(postgresAddrEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AfterConnect = rightserver.PrepareStatements
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return rightserver.NewPgxStore(pool, postgres.IsRetryable, sql.LevelDefault, "")
+}
+
+func openPostgresDB(t testing.TB) *sql.DB {
+	db, err := sql.Open("pgx", os.Getenv(postgresAddrEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	ctx := context.Background()
+	migrator, err := migration.New(db, migration.Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.ExecContext(ctx, truncateQuery); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,188 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	"google.golang.org/grpc/peer"
+)
+
+// replicaStore sends the reads to a replica and the writes to the primary,
+// the reads of a caller go to the primary for a while after its last write (read your writes).
+// The window is local to this process and a replica lagging more than it can still return stale data.
+type replicaStore struct {
+	Store
+	replica       Store
+	window        time.Duration
+	writersMutex  sync.RWMutex
+	writerToLimit map[string]time.Time
+}
+
+// NewReplicaStore returns a Store reading from replica except for the callers (identified by their gRPC peer host)
+// which wrote in primary less than window ago.
+func NewReplicaStore(primary Store, replica Store, window time.Duration) Store {
+	return &replicaStore{Store: primary, replica: replica, window: window, writerToLimit: map[string]time.Time{}}
+}
+
+func (s *replicaStore) GetAllRoles(ctx context.Context) ([]model.Role, error) {
+	return s.reader(ctx).GetAllRoles(ctx)
+}
+
+func (s *replicaStore) GetRolesByUserId(ctx context.Context, userId uint64) ([]model.Role, error) {
+	return s.reader(ctx).GetRolesByUserId(ctx, userId)
+}
+
+func (s *replicaStore) GetRolesByObjectIds(ctx context.Context, objectIds []uint64) ([]model.Role, error) {
+	return s.reader(ctx).GetRolesByObjectIds(ctx, objectIds)
+}
+
+func (s *replicaStore) GetRoleByNameAndObjectId(ctx context.Context, name string, objectId uint64) (model.Role, error) {
+	return s.reader(ctx).GetRoleByNameAndObjectId(ctx, name, objectId)
+}
+
+func (s *replicaStore) GetRoleByNameIdAndObjectId(ctx context.Context, nameId uint64, objectId uint64) (model.Role, error) {
+	return s.reader(ctx).GetRoleByNameIdAndObjectId(ctx, nameId, objectId)
+}
+
+func (s *replicaStore) GetRolesByNamesAndObjectIds(ctx context.Context, nameToObjectIds map[string][]uint64) ([]model.Role, error) {
+	return s.reader(ctx).GetRolesByNamesAndObjectIds(ctx, nameToObjectIds)
+}
+
+func (s *replicaStore) CreateRole(ctx context.Context, role model.Role) (bool, error) {
+	defer s.markWriter(ctx)
+	return s.Store.CreateRole(ctx, role)
+}
+
+func (s *replicaStore) UpdateRole(ctx context.Context, role model.Role) (bool, error) {
+	defer s.markWriter(ctx)
+	return s.Store.UpdateRole(ctx, role)
+}
+
+func (s *replicaStore) DeleteRole(ctx context.Context, role model.Role) error {
+	defer s.markWriter(ctx)
+	return s.Store.DeleteRole(ctx, role)
+}
+
+func (s *replicaStore) DeleteRolesByObjectIds(ctx context.Context, objectIds []uint64) (int64, int64, error) {
+	defer s.markWriter(ctx)
+	return s.Store.DeleteRolesByObjectIds(ctx, objectIds)
+}
+
+func (s *replicaStore) GetRoleNameByName(ctx context.Context, name string) (model.RoleName, error) {
+	return s.reader(ctx).GetRoleNameByName(ctx, name)
+}
+
+// always from the primary, the names are cached and the invalidation notified at the commit
+// must not be followed by the load of a stale name from a lagging replica
+func (s *replicaStore) GetRoleNamesByIds(ctx context.Context, ids []uint64) ([]model.RoleName, error) {
+	return s.Store.GetRoleNamesByIds(ctx, ids)
+}
+
+func (s *replicaStore) CreateRoleName(ctx context.Context, roleName model.RoleName) error {
+	defer s.markWriter(ctx)
+	return s.Store.CreateRoleName(ctx, roleName)
+}
+
+func (s *replicaStore) UpdateRoleName(ctx context.Context, roleName model.RoleName) error {
+	defer s.markWriter(ctx)
+	return s.Store.UpdateRoleName(ctx, roleName)
+}
+
+func (s *replicaStore) DeleteUnusedRoleNames(ctx context.Context) (int64, error) {
+	defer s.markWriter(ctx)
+	return s.Store.DeleteUnusedRoleNames(ctx)
+}
+
+func (s *replicaStore) GetAllUserRoles(ctx context.Context) ([]model.UserRole, error) {
+	return s.reader(ctx).GetAllUserRoles(ctx)
+}
+
+func (s *replicaStore) CreateUserRole(ctx context.Context, userRole model.UserRole) error {
+	defer s.markWriter(ctx)
+	return s.Store.CreateUserRole(ctx, userRole)
+}
+
+func (s *replicaStore) DeleteUserRolesByUserId(ctx context.Context, userId uint64) (int64, error) {
+	defer s.markWriter(ctx)
+	return s.Store.DeleteUserRolesByUserId(ctx, userId)
+}
+
+func (s *replicaStore) GetAuthData(ctx context.Context, userId uint64, objectId uint64) (AuthData, error) {
+	return s.reader(ctx).GetAuthData(ctx, userId, objectId)
+}
+
+func (s *replicaStore) CreateAuditEntry(ctx context.Context, rpc string, kind string, userId uint64, objectId uint64, roleName string, beforeFlags uint8, afterFlags uint8) error {
+	defer s.markWriter(ctx)
+	return s.Store.CreateAuditEntry(ctx, rpc, kind, userId, objectId, roleName, beforeFlags, afterFlags)
+}
+
+// the transaction (reads included) use the primary
+func (s *replicaStore) Transaction(ctx context.Context, f func(Store) error) error {
+	defer s.markWriter(ctx)
+	return s.Store.Transaction(ctx, f)
+}
+
+func (s *replicaStore) reader(ctx context.Context) Store {
+	writer := callerKey(ctx)
+	now := time.Now()
+
+	// the expired entries are removed by markWriter
+	s.writersMutex.RLock()
+	limit, ok := s.writerToLimit[writer]
+	s.writersMutex.RUnlock()
+	if ok && now.Before(limit) {
+		return s.Store
+	}
+	return s.replica
+}
+
+// called after the write, the replication delay start with the commit
+func (s *replicaStore) markWriter(ctx context.Context) {
+	writer := callerKey(ctx)
+	now := time.Now()
+
+	s.writersMutex.Lock()
+	defer s.writersMutex.Unlock()
+	for otherWriter, limit := range s.writerToLimit {
+		if now.After(limit) {
+			delete(s.writerToLimit, otherWriter)
+		}
+	}
+	s.writerToLimit[writer] = now.Add(s.window)
+}
+
+// the host of the gRPC peer, so all the connections of a caller share the same key
+// (but also all the callers behind the same host or proxy)
+func callerKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,130 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	pb "github.com/dvaumoron/puzzlerightservice"
+	"google.golang.org/grpc/peer"
+)
+
+// laggingStore is a replica which has not yet received the changes of the role names
+type laggingStore struct {
+	rightserver.Store
+	idToName map[uint64]string
+}
+
+func (s laggingStore) GetRoleNamesByIds(ctx context.Context, ids []uint64) ([]model.RoleName, error) {
+	roleNames := make([]model.RoleName, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := s.idToName[id]; ok {
+			roleNames = append(roleNames, model.MakeRoleName(id, name))
+		}
+	}
+	return roleNames, nil
+}
+
+func TestReplicaStoreRenamedRoleName(t *testing.T) {
+	primary := rightserver.NewMemoryStore()
+	ctx := context.Background()
+	role := createTestRole(t, primary, "guest", 5)
+
+	names := rightserver.NewNameCache()
+	replica := laggingStore{Store: primary, idToName: map[uint64]string{role.NameId: "guest"}}
+	server := newCustomTestServer(t, rightserver.NewReplicaStore(primary, replica, time.Second), rightserver.NewManaged(false), names)
+	request := &pb.ObjectIds{Ids: []uint64{5}}
+	if _, err := server.ListRoles(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rightserver.RenameRole(ctx, primary, "guest", "visitor", false); err != nil {
+		t.Fatal(err)
+	}
+	// sent by the transaction of the rename
+	names.HandleNotification("name:" + strconv.FormatUint(role.NameId, 10))
+
+	roles, err := server.ListRoles(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := roleKeys(roles.List); !equalStrings(keys, []string{roleKey("visitor", 5)}) {
+		t.Errorf("expected the new name, got %v", keys)
+	}
+}
+
+func callerContext(ip string, port int) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}})
+}
+
+// the primary has a role on object 5 and the replica on object 6
+func readFrom(t *testing.T, ctx context.Context, store rightserver.Store) string {
+	t.Helper()
+	roles, err := store.GetRolesByObjectIds(ctx, []uint64{5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 {
+		t.Fatalf("expected 1 role, got %d", len(roles))
+	}
+	if roles[0].ObjectId == 5 {
+		return "primary"
+	}
+	return "replica"
+}
+
+func TestReplicaStoreRouting(t *testing.T) {
+	primary := rightserver.NewMemoryStore()
+	createTestRole(t, primary, "editor", 5)
+	replica := rightserver.NewMemoryStore()
+	createTestRole(t, replica, "editor", 6)
+
+	const window = 100 * time.Millisecond
+	store := rightserver.NewReplicaStore(primary, replica, window)
+	writerCtx := callerContext("10.0.0.1", 4000)
+	otherCtx := callerContext("10.0.0.2", 4000)
+	if source := readFrom(t, writerCtx, store); source != "replica" {
+		t.Errorf("read from %s before any write", source)
+	}
+
+	if err := store.CreateAuditEntry(writerCtx, "Test", "role", 0, 5, "editor", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if source := readFrom(t, writerCtx, store); source != "primary" {
+		t.Errorf("read from %s just after a write", source)
+	}
+	// the callers are identified by host
+	if source := readFrom(t, callerContext("10.0.0.1", 5000), store); source != "primary" {
+		t.Errorf("read from %s by another connection of the writer", source)
+	}
+	if source := readFrom(t, otherCtx, store); source != "replica" {
+		t.Errorf("read from %s by another caller", source)
+	}
+
+	time.Sleep(2 * window)
+	if source := readFrom(t, writerCtx, store); source != "replica" {
+		t.Errorf("read from %s after the window", source)
+	}
+}
@@ -22,63 +22,73 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"sync"
 
 	"github.com/dvaumoron/puzzlerightserver/model"
 	pb "github.com/dvaumoron/puzzlerightservice"
-	_ "github.com/jackc/pgx/v5"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/uptrace/opentelemetry-go-extra/otelzap"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	RightKey = "puzzleRight"
 
-	publicObjectId = 0
-	dbAccessMsg    = "Failed to access database"
+	dbAccessMsg = "Failed to access database"
+
+	auditUpdateUser = "UpdateUser"
+	auditUpdateRole = "UpdateRole"
 )
 
 var errInternal = errors.New("internal service error")
 
+var (
+	errProtectedObject = status.Error(codes.PermissionDenied, "rights on protected object are not updatable")
+	errRoleConflict    = status.Error(codes.Aborted, "role modified concurrently")
+	errManagedRole     = status.Error(codes.FailedPrecondition, "role managed by the rights configuration")
+	errManagedUser     = status.Error(codes.FailedPrecondition, "user roles managed by the rights configuration")
+)
+
 type empty = struct{}
 
 // server is used to implement puzzlerightservice.RightServer.
 type server struct {
 	pb.UnimplementedRightServer
-	db            *sql.DB
-	rule          rego.PreparedEvalQuery
-	idToNameMutex sync.RWMutex
-	idToName      map[uint64]string
-	logger        *otelzap.Logger
+	store              Store
+	protectedObjectIds map[uint64]empty
+	managed            *Managed
+	rule               rego.PreparedEvalQuery
+	names              *NameCache
+	logger             *otelzap.Logger
 }
 
-func New(db *sql.DB, opaRule rego.PreparedEvalQuery, logger *otelzap.Logger) pb.RightServer {
-	return &server{db: db, rule: opaRule, idToName: map[uint64]string{}, logger: logger}
+func New(store Store, protectedObjectIds []uint64, managed *Managed, names *NameCache, opaRule rego.PreparedEvalQuery, logger *otelzap.Logger) pb.RightServer {
+	return &server{
+		store: store, protectedObjectIds: makeIdSet(protectedObjectIds), managed: managed, names: names,
+		rule: opaRule, logger: logger,
+	}
 }
 
 func (s *server) AuthQuery(ctx context.Context, request *pb.RightRequest) (*pb.Response, error) {
 	logger := s.logger.Ctx(ctx)
-	conn, err := s.db.Conn(ctx)
+
+	// anonymous user (id 0) can have roles like any other user
+	userId := request.UserId
+	data, err := s.store.GetAuthData(ctx, userId, request.ObjectId)
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer conn.Close()
-
-	var roles []model.Role
-	userId := request.UserId
-	if userId != 0 {
-		if roles, err = model.GetRolesByUserId(conn, ctx, userId); err != nil {
-			logger.Error(dbAccessMsg, zap.Error(err))
-			return nil, errInternal
-		}
-	}
 
 	input := map[string]any{
 		"userId": userId, "objectId": request.ObjectId,
-		"actionFlag": convertActionToFlag(request.Action),
-		"userRoles":  convertDataFromRolesModel(roles),
+		"actionFlag":     convertActionToFlag(request.Action),
+		"userRoles":      convertDataFromRolesModel(data.Roles),
+		"userAttributes": convertDataFromAttributesModel(data.UserAttributes),
+	}
+	if data.ObjectFound {
+		input["object"] = convertDataFromObjectModel(data.Object, data.ObjectAttributes)
 	}
 	results, err := s.rule.Eval(ctx, rego.EvalInput(input))
 	if err != nil {
@@ -90,20 +100,13 @@ func (s *server) AuthQuery(ctx context.Context, request *pb.RightRequest) (*pb.R
 
 func (s *server) ListRoles(ctx context.Context, request *pb.ObjectIds) (*pb.Roles, error) {
 	logger := s.logger.Ctx(ctx)
-	conn, err := s.db.Conn(ctx)
+	roles, err := s.store.GetRolesByObjectIds(ctx, request.Ids)
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer conn.Close()
 
-	roles, err := model.GetRolesByObjectIds(conn, ctx, request.Ids)
-	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
-	}
-
-	resRoles, err := s.convertRolesFromModel(conn, logger, roles)
+	resRoles, err := s.convertRolesFromModel(s.store, logger, roles)
 	if err != nil {
 		return nil, err
 	}
@@ -112,14 +115,7 @@ func (s *server) ListRoles(ctx context.Context, request *pb.ObjectIds) (*pb.Role
 
 func (s *server) RoleRight(ctx context.Context, request *pb.RoleRequest) (*pb.Actions, error) {
 	logger := s.logger.Ctx(ctx)
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
-	}
-	defer conn.Close()
-
-	role, err := model.GetRoleByNameAndObjectId(conn, ctx, request.Name, request.ObjectId)
+	role, err := s.store.GetRoleByNameAndObjectId(ctx, request.Name, request.ObjectId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// ignore unknown role
@@ -134,202 +130,291 @@ func (s *server) RoleRight(ctx context.Context, request *pb.RoleRequest) (*pb.Ac
 	return &pb.Actions{List: actions}, nil
 }
 
-func (s *server) UpdateUser(ctx context.Context, request *pb.UserRight) (response *pb.Response, err error) {
+func (s *server) UpdateUser(ctx context.Context, request *pb.UserRight) (*pb.Response, error) {
 	logger := s.logger.Ctx(ctx)
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+	userId := request.UserId
+	if s.managed.hasUser(userId) {
+		if s.managed.reject {
+			logger.Warn("Refused update of user managed by configuration", zap.Uint64("userId", userId))
+			s.auditRefusedUser(logger, userId, request.List)
+			return nil, errManagedUser
+		}
+		logger.Warn("Update of user managed by configuration", zap.Uint64("userId", userId))
 	}
-	defer conn.Close()
 
-	roles, err := loadRoles(conn, logger, request.List)
-	if err != nil {
-		return
-	}
+	err := s.store.Transaction(ctx, func(tx Store) error {
+		roles, err := loadRoles(tx, logger, request.List)
+		if err != nil {
+			return err
+		}
 
-	userId := request.UserId
-	if len(roles) == 0 {
-		// delete unused user
-		if _, err = model.DeleteUserRolesByUserId(conn, ctx, userId); err != nil {
+		oldRoles, err := tx.GetRolesByUserId(ctx, userId)
+		if err != nil {
 			logger.Error(dbAccessMsg, zap.Error(err))
-			return nil, errInternal
+			return errInternal
+		}
+
+		if _, err = tx.DeleteUserRolesByUserId(ctx, userId); err != nil {
+			logger.Error(dbAccessMsg, zap.Error(err))
+			return errInternal
+		}
+
+		for _, role := range roles {
+			if err = tx.CreateUserRole(ctx, model.MakeUserRole(0, userId, role.Id)); err != nil {
+				logger.Error(dbAccessMsg, zap.Error(err))
+				return errInternal
+			}
 		}
-		return &pb.Response{Success: true}, nil
-	}
 
-	tx, err := conn.BeginTx(ctx, nil)
+		if err = s.auditUserRoles(tx, logger, userId, diffRoles(oldRoles, roles), true); err != nil {
+			return err
+		}
+		return s.auditUserRoles(tx, logger, userId, diffRoles(roles, oldRoles), false)
+	})
 	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return
+		return nil, checkTxError(logger, err)
 	}
-	defer commitOrRollBack(tx, logger, &err)
+	return &pb.Response{Success: true}, nil
+}
 
-	if _, err = model.DeleteUserRolesByUserId(tx, ctx, userId); err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+func (s *server) UpdateRole(ctx context.Context, request *pb.Role) (*pb.Response, error) {
+	logger := s.logger.Ctx(ctx)
+	name := request.Name
+	objectId := request.ObjectId
+
+	if _, protected := s.protectedObjectIds[objectId]; protected {
+		logger.Warn("Refused update of role on protected object", zap.String("name", name), zap.Uint64("objectId", objectId))
+		s.auditRefusal(logger, auditUpdateRole, auditRefusedRoleKind, 0, objectId, name, convertActionsToFlags(request.List))
+		return nil, errProtectedObject
+	}
+	if s.managed.hasRole(name, objectId) {
+		if s.managed.reject {
+			logger.Warn("Refused update of role managed by configuration", zap.String("name", name), zap.Uint64("objectId", objectId))
+			s.auditRefusal(logger, auditUpdateRole, auditRefusedRoleKind, 0, objectId, name, convertActionsToFlags(request.List))
+			return nil, errManagedRole
+		}
+		logger.Warn("Update of role managed by configuration", zap.String("name", name), zap.Uint64("objectId", objectId))
 	}
 
-	for _, role := range roles {
-		if err = model.MakeUserRole(0, userId, role.Id).Create(tx, ctx); err != nil {
-			logger.Error(dbAccessMsg, zap.Error(err))
-			return nil, errInternal
+	actionFlags := convertActionsToFlags(request.List)
+	if actionFlags == 0 {
+		var deletedNameId uint64
+		if err := s.store.Transaction(ctx, func(tx Store) (err error) {
+			deletedNameId, err = deleteRole(tx, logger, name, objectId)
+			return err
+		}); err != nil {
+			return nil, checkTxError(logger, err)
+		}
+
+		if deletedNameId != 0 {
+			// invalidate the cache of name (other instances are notified by the transaction)
+			s.names.Invalidate(deletedNameId)
 		}
+		return &pb.Response{Success: true}, nil
+	}
+
+	if err := s.store.Transaction(ctx, func(tx Store) error {
+		return upsertRole(tx, logger, name, objectId, actionFlags)
+	}); err != nil {
+		return nil, checkTxError(logger, err)
 	}
 	return &pb.Response{Success: true}, nil
 }
 
-func (s *server) UpdateRole(ctx context.Context, request *pb.Role) (response *pb.Response, err error) {
+func (s *server) ListUserRoles(ctx context.Context, request *pb.UserId) (*pb.Roles, error) {
 	logger := s.logger.Ctx(ctx)
-	conn, err := s.db.Conn(ctx)
+	roles, err := s.store.GetRolesByUserId(ctx, request.Id)
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer conn.Close()
 
-	name := request.Name
-	objectId := request.ObjectId
-
-	if objectId == publicObjectId {
-		// right on public part are not updatable, return false (bool default)
-		return &pb.Response{}, nil
+	resRoles, err := s.convertRolesFromModel(s.store, logger, roles)
+	if err != nil {
+		return nil, err
 	}
+	return &pb.Roles{List: resRoles}, nil
+}
 
-	actionFlags := convertActionsToFlags(request.List)
-	if actionFlags == 0 {
-		// delete unused role
-		role, err := model.GetRoleByNameAndObjectId(conn, ctx, name, objectId)
-		if err != sql.ErrNoRows {
-			if err == nil {
-				err = role.Delete(conn, ctx)
-			}
-			if err != nil {
-				logger.Error(dbAccessMsg, zap.Error(err))
-				return nil, errInternal
+// return the id of the name of the deleted role when it is deleted too (0 otherwise)
+func deleteRole(tx Store, logger otelzap.LoggerWithCtx, name string, objectId uint64) (uint64, error) {
+	ctx := logger.Context()
+	role, err := tx.GetRoleByNameAndObjectId(ctx, name, objectId)
+	if err != sql.ErrNoRows {
+		if err == nil {
+			if err = tx.DeleteRole(ctx, role); err == nil {
+				err = tx.CreateAuditEntry(ctx, auditUpdateRole, auditRoleKind, 0, objectId, name, role.ActionFlags, 0)
 			}
 		}
+		if err != nil {
+			logger.Error(dbAccessMsg, zap.Error(err))
+			return 0, errInternal
+		}
+	}
 
-		// we delete the names without roles
-		if _, err = model.DeleteUnusedRoleNames(conn, ctx); err != nil {
+	// we delete the names without roles
+	deleted, err := tx.DeleteUnusedRoleNames(ctx)
+	if err != nil {
+		logger.Error(dbAccessMsg, zap.Error(err))
+		return 0, errInternal
+	}
+
+	// role.NameId is 0 when the role does not exist
+	if deleted == 0 || role.NameId == 0 {
+		return 0, nil
+	}
+	if _, err = tx.GetRoleNameByName(ctx, name); err != sql.ErrNoRows {
+		if err != nil {
 			logger.Error(dbAccessMsg, zap.Error(err))
-			return nil, errInternal
+			return 0, errInternal
 		}
+		// still used by roles on other objects
+		return 0, nil
+	}
 
-		// invalidate the cache of name
-		s.idToNameMutex.Lock()
-		s.idToName = map[uint64]string{}
-		s.idToNameMutex.Unlock()
-		return &pb.Response{Success: true}, nil
+	if err = tx.Notify(ctx, changedNamePayload(role.NameId)); err != nil {
+		logger.Error(dbAccessMsg, zap.Error(err))
+		return 0, errInternal
 	}
+	return role.NameId, nil
+}
 
-	tx, err := conn.BeginTx(ctx, nil)
+func upsertRole(tx Store, logger otelzap.LoggerWithCtx, name string, objectId uint64, actionFlags uint8) error {
+	ctx := logger.Context()
+	roleName, err := tx.GetRoleNameByName(ctx, name)
+	if err == sql.ErrNoRows {
+		// insert or get, the name could be created by a concurrent call
+		if err = tx.CreateRoleName(ctx, model.MakeRoleName(0, name)); err == nil {
+			// must retrieve the id
+			roleName, err = tx.GetRoleNameByName(ctx, name)
+		}
+	}
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+		return errInternal
 	}
-	defer commitOrRollBack(tx, logger, &err)
 
-	roleName, err := model.GetRoleNameByName(tx, ctx, name)
+	role, err := tx.GetRoleByNameIdAndObjectId(ctx, roleName.Id, objectId)
 	if err == sql.ErrNoRows {
-		if err = model.MakeRoleName(0, name).Create(tx, ctx); err == nil {
-			// must retrieve the id
-			roleName, err = model.GetRoleNameByName(tx, ctx, name)
+		var created bool
+		if created, err = tx.CreateRole(ctx, model.MakeRole(0, roleName.Id, objectId, actionFlags, 0)); err == nil {
+			if created {
+				if err = tx.CreateAuditEntry(ctx, auditUpdateRole, auditRoleKind, 0, objectId, name, 0, actionFlags); err != nil {
+					logger.Error(dbAccessMsg, zap.Error(err))
+					return errInternal
+				}
+				return nil
+			}
+
+			// created by a concurrent call, update it instead
+			role, err = tx.GetRoleByNameIdAndObjectId(ctx, roleName.Id, objectId)
 		}
 	}
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+		return errInternal
 	}
 
-	role, err := model.GetRoleByNameIdAndObjectId(tx, ctx, roleName.Id, objectId)
+	beforeFlags := role.ActionFlags
+	if beforeFlags == actionFlags {
+		// nothing to do (like for the loser of concurrent identical calls once retried)
+		return nil
+	}
+
+	role.ActionFlags = actionFlags
+	updated, err := tx.UpdateRole(ctx, role)
 	if err == nil {
-		role.ActionFlags = actionFlags
-		if err = role.Update(tx, ctx); err != nil {
-			logger.Error(dbAccessMsg, zap.Error(err))
-			return nil, errInternal
+		if !updated {
+			// the transaction is retried (Store.UpdateRole)
+			logger.Info("Concurrent modification of role", zap.String("name", name), zap.Uint64("objectId", objectId))
+			return errRoleConflict
 		}
-
-		return &pb.Response{Success: true}, nil
+		err = tx.CreateAuditEntry(ctx, auditUpdateRole, auditRoleKind, 0, objectId, name, beforeFlags, actionFlags)
 	}
-	if err != sql.ErrNoRows {
+	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+		return errInternal
 	}
+	return nil
+}
 
-	role = model.MakeRole(0, roleName.Id, objectId, actionFlags)
-	if err = role.Create(tx, ctx); err != nil {
+// the refusal is returned even when its audit fails
+func (s *server) auditRefusal(logger otelzap.LoggerWithCtx, rpc string, kind string, userId uint64, objectId uint64, name string, afterFlags uint8) {
+	if err := s.store.CreateAuditEntry(logger.Context(), rpc, kind, userId, objectId, name, 0, afterFlags); err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
 	}
-	return &pb.Response{Success: true}, nil
 }
 
-func (s *server) ListUserRoles(ctx context.Context, request *pb.UserId) (*pb.Roles, error) {
-	logger := s.logger.Ctx(ctx)
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+// one entry by requested role (or an entry without role when all the roles would have been removed)
+func (s *server) auditRefusedUser(logger otelzap.LoggerWithCtx, userId uint64, roles []*pb.RoleRequest) {
+	if len(roles) == 0 {
+		s.auditRefusal(logger, auditUpdateUser, auditRefusedUserKind, userId, 0, "", 0)
+		return
 	}
-	defer conn.Close()
 
-	roles, err := model.GetRolesByUserId(conn, ctx, request.Id)
-	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
+	for _, role := range roles {
+		s.auditRefusal(logger, auditUpdateUser, auditRefusedUserKind, userId, role.ObjectId, role.Name, 0)
 	}
+}
 
-	resRoles, err := s.convertRolesFromModel(conn, logger, roles)
+func loadRoles(store Store, logger otelzap.LoggerWithCtx, roles []*pb.RoleRequest) ([]model.Role, error) {
+	resRoles, err := store.GetRolesByNamesAndObjectIds(logger.Context(), extractNamesToObjectIds(roles))
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	return &pb.Roles{List: resRoles}, nil
+	return resRoles, nil
 }
 
-func loadRoles(conn *sql.Conn, logger otelzap.LoggerWithCtx, roles []*pb.RoleRequest) ([]model.Role, error) {
+// write an audit entry for each role granted (or revoked when removed is true) to the user
+func (s *server) auditUserRoles(tx Store, logger otelzap.LoggerWithCtx, userId uint64, roles []model.Role, removed bool) error {
+	resRoles, err := s.convertRolesFromModel(tx, logger, roles)
+	if err != nil {
+		return err
+	}
+
 	ctx := logger.Context()
-	resRoles := make([]model.Role, 0, len(roles)) // probably lot more space than necessary
-	for name, objectIds := range extractNamesToObjectIds(roles) {
-		roles, err := model.GetRolesByNameAndObjectIds(conn, ctx, name, objectIds)
-		if err != nil {
-			logger.Error(dbAccessMsg, zap.Error(err))
-			return nil, errInternal
+	for index, resRole := range resRoles {
+		var beforeFlags, afterFlags uint8
+		if removed {
+			beforeFlags = roles[index].ActionFlags
+		} else {
+			afterFlags = roles[index].ActionFlags
 		}
-		if len(roles) != 0 {
-			resRoles = append(resRoles, roles...)
+		if err = tx.CreateAuditEntry(ctx, auditUpdateUser, auditUserRoleKind, userId, resRole.ObjectId, resRole.Name, beforeFlags, afterFlags); err != nil {
+			logger.Error(dbAccessMsg, zap.Error(err))
+			return errInternal
 		}
 	}
-	return resRoles, nil
+	return nil
 }
 
-func (s *server) convertRolesFromModel(conn *sql.Conn, logger otelzap.LoggerWithCtx, roles []model.Role) ([]*pb.Role, error) {
+func (s *server) convertRolesFromModel(store Store, logger otelzap.LoggerWithCtx, roles []model.Role) ([]*pb.Role, error) {
 	allThere := true
 	resRoles := make([]*pb.Role, 0, len(roles))
-	s.idToNameMutex.RLock()
+	s.names.mutex.RLock()
 	for _, role := range roles {
 		var name string
 		id := role.NameId
-		name, allThere = s.idToName[id]
+		name, allThere = s.names.idToName[id]
 		if !allThere {
 			break
 		}
 		resRoles = append(resRoles, convertRoleFromModel(name, role))
 	}
-	s.idToNameMutex.RUnlock()
+	s.names.mutex.RUnlock()
 	if allThere {
 		return resRoles, nil
 	}
 
-	s.idToNameMutex.Lock()
-	defer s.idToNameMutex.Unlock()
+	s.names.mutex.Lock()
+	defer s.names.mutex.Unlock()
 	allThere = true
 	resRoles = resRoles[:0]
 	missingIdSet := map[uint64]empty{}
 	for _, role := range roles {
 		id := role.NameId
-		name, ok := s.idToName[id]
+		name, ok := s.names.idToName[id]
 		if ok {
 			resRoles = append(resRoles, convertRoleFromModel(name, role))
 		} else {
@@ -346,23 +431,38 @@ func (s *server) convertRolesFromModel(conn *sql.Conn, logger otelzap.LoggerWith
 		queryIds = append(queryIds, id)
 	}
 
-	roleNames, err := model.GetRoleNamesByIds(conn, logger.Context(), queryIds)
+	roleNames, err := store.GetRoleNamesByIds(logger.Context(), queryIds)
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
 
 	for _, roleName := range roleNames {
-		s.idToName[roleName.Id] = roleName.Name
+		s.names.idToName[roleName.Id] = roleName.Name
 	}
 
 	resRoles = resRoles[:0]
 	for _, role := range roles {
-		resRoles = append(resRoles, convertRoleFromModel(s.idToName[role.NameId], role))
+		resRoles = append(resRoles, convertRoleFromModel(s.names.idToName[role.NameId], role))
 	}
 	return resRoles, nil
 }
 
+// return the roles which are not in others
+func diffRoles(roles []model.Role, others []model.Role) []model.Role {
+	otherIdSet := make(map[uint64]empty, len(others))
+	for _, other := range others {
+		otherIdSet[other.Id] = empty{}
+	}
+	resRoles := make([]model.Role, 0, len(roles))
+	for _, role := range roles {
+		if _, ok := otherIdSet[role.Id]; !ok {
+			resRoles = append(resRoles, role)
+		}
+	}
+	return resRoles
+}
+
 func convertRoleFromModel(name string, role model.Role) *pb.Role {
 	return &pb.Role{
 		Name: name, ObjectId: role.ObjectId,
@@ -381,15 +481,33 @@ func convertDataFromRolesModel(roles []model.Role) []any {
 	return res
 }
 
-func commitOrRollBack(tx *sql.Tx, logger otelzap.LoggerWithCtx, err *error) {
-	if r := recover(); r != nil {
-		tx.Rollback()
-		logger.Error(dbAccessMsg, zap.Any("recover", r))
-	} else if *err == nil {
-		tx.Commit()
-	} else {
-		tx.Rollback()
+func convertDataFromAttributesModel(attributes []model.UserAttribute) map[string]any {
+	res := make(map[string]any, len(attributes))
+	for _, attribute := range attributes {
+		res[attribute.Name] = attribute.Value
+	}
+	return res
+}
+
+func convertDataFromObjectModel(object model.Object, attributes []model.ObjectAttribute) map[string]any {
+	attributesData := make(map[string]any, len(attributes))
+	for _, attribute := range attributes {
+		attributesData[attribute.Name] = attribute.Value
+	}
+	return map[string]any{
+		"objectId": object.ObjectId, "type": object.ObjectType,
+		"name": object.Name, "attributes": attributesData,
+	}
+}
+
+// errors returned by the transaction itself (begin, panic) are not logged yet
+func checkTxError(logger otelzap.LoggerWithCtx, err error) error {
+	switch err {
+	case errInternal, errRoleConflict:
+		return err
 	}
+	logger.Error(dbAccessMsg, zap.Error(err))
+	return errInternal
 }
 
 func convertActionsFromFlags(actionFlags uint8) []pb.RightAction {
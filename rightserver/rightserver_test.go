@@ -0,0 +1,308 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	pb "github.com/dvaumoron/puzzlerightservice"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// allow the actions granted by the roles of the user on the object
+const testPolicy = `package auth
+import future.keywords
+default allow := false
+allow {
+	some role in input.userRoles
+	role.objectId == input.objectId
+	bits.and(role.actionFlags, input.actionFlag) != 0
+}
+`
+
+const protectedObjectId = 0
+
+type storeFactory struct {
+	name     string
+	newStore func(t testing.TB) rightserver.Store
+}
+
+// each backend registers its factory (in an init), the tests run against all of them
+var storeFactories []storeFactory
+
+func forEachStore(t *testing.T, test func(t *testing.T, store rightserver.Store)) {
+	if len(storeFactories) == 0 {
+		t.Skip("no store available")
+	}
+
+	for _, factory := range storeFactories {
+		factory := factory
+		t.Run(factory.name, func(t *testing.T) {
+			test(t, factory.newStore(t))
+		})
+	}
+}
+
+func newTestServer(t testing.TB, store rightserver.Store) pb.RightServer {
+	return newCustomTestServer(t, store, rightserver.NewManaged(false), rightserver.NewNameCache())
+}
+
+// managed allows to reconcile a configuration and names to send the notifications of other instances
+func newCustomTestServer(t testing.TB, store rightserver.Store, managed *rightserver.Managed, names *rightserver.NameCache) pb.RightServer {
+	query, err := rego.New(rego.Query("data.auth.allow"), rego.Module("auth.rego", testPolicy)).PrepareForEval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rightserver.New(
+		store, []uint64{protectedObjectId}, managed, names, query, otelzap.New(zap.NewNop()),
+	)
+}
+
+func mustUpdateRole(t testing.TB, server pb.RightServer, name string, objectId uint64, actions ...pb.RightAction) {
+	t.Helper()
+	if _, err := server.UpdateRole(context.Background(), &pb.Role{Name: name, ObjectId: objectId, List: actions}); err != nil {
+		t.Fatalf("UpdateRole(%q, %d) failed : %v", name, objectId, err)
+	}
+}
+
+func mustUpdateUser(t testing.TB, server pb.RightServer, userId uint64, roles ...*pb.RoleRequest) {
+	t.Helper()
+	if _, err := server.UpdateUser(context.Background(), &pb.UserRight{UserId: userId, List: roles}); err != nil {
+		t.Fatalf("UpdateUser(%d) failed : %v", userId, err)
+	}
+}
+
+func roleActions(t testing.TB, server pb.RightServer, name string, objectId uint64) []pb.RightAction {
+	t.Helper()
+	actions, err := server.RoleRight(context.Background(), &pb.RoleRequest{Name: name, ObjectId: objectId})
+	if err != nil {
+		t.Fatalf("RoleRight(%q, %d) failed : %v", name, objectId, err)
+	}
+	return actions.List
+}
+
+func allowed(t testing.TB, server pb.RightServer, userId uint64, objectId uint64, action pb.RightAction) bool {
+	t.Helper()
+	response, err := server.AuthQuery(context.Background(), &pb.RightRequest{UserId: userId, ObjectId: objectId, Action: action})
+	if err != nil {
+		t.Fatalf("AuthQuery(%d, %d, %v) failed : %v", userId, objectId, action, err)
+	}
+	return response.Success
+}
+
+// "name@objectId" sorted, to compare role lists
+func roleKeys(roles []*pb.Role) []string {
+	keys := make([]string, 0, len(roles))
+	for _, role := range roles {
+		keys = append(keys, roleKey(role.Name, role.ObjectId))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func roleKey(name string, objectId uint64) string {
+	return name + "@" + strconv.FormatUint(objectId, 10)
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index, value := range a {
+		if value != b[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalActions(actions []pb.RightAction, expected ...pb.RightAction) bool {
+	if len(actions) != len(expected) {
+		return false
+	}
+	for index, action := range actions {
+		if action != expected[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUpdateRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+		if actions := roleActions(t, server, "editor", 5); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_UPDATE) {
+			t.Errorf("unexpected actions after creation : %v", actions)
+		}
+
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_CREATE)
+		if actions := roleActions(t, server, "editor", 5); !equalActions(actions, pb.RightAction_CREATE) {
+			t.Errorf("unexpected actions after update : %v", actions)
+		}
+
+		// an empty list deletes the role
+		mustUpdateRole(t, server, "editor", 5)
+		if actions := roleActions(t, server, "editor", 5); len(actions) != 0 {
+			t.Errorf("unexpected actions after deletion : %v", actions)
+		}
+
+		// deleting an unknown role is not an error
+		mustUpdateRole(t, server, "unknown", 5)
+	})
+}
+
+func TestUpdateRoleProtectedObject(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+
+		_, err := server.UpdateRole(context.Background(), &pb.Role{
+			Name: "editor", ObjectId: protectedObjectId, List: []pb.RightAction{pb.RightAction_ACCESS},
+		})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("expected PermissionDenied, got %v", err)
+		}
+		if actions := roleActions(t, server, "editor", protectedObjectId); len(actions) != 0 {
+			t.Errorf("role created on protected object : %v", actions)
+		}
+	})
+}
+
+func TestListRoles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_UPDATE)
+		mustUpdateRole(t, server, "viewer", 5, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "viewer", 6, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "viewer", 7, pb.RightAction_ACCESS)
+
+		roles, err := server.ListRoles(context.Background(), &pb.ObjectIds{Ids: []uint64{5, 6}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{roleKey("editor", 5), roleKey("viewer", 5), roleKey("viewer", 6)}
+		if keys := roleKeys(roles.List); !equalStrings(keys, expected) {
+			t.Errorf("expected %v, got %v", expected, keys)
+		}
+	})
+}
+
+func TestUpdateUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_UPDATE)
+		mustUpdateRole(t, server, "viewer", 5, pb.RightAction_ACCESS)
+
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5}, &pb.RoleRequest{Name: "viewer", ObjectId: 5})
+		roles, err := server.ListUserRoles(ctx, &pb.UserId{Id: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := roleKeys(roles.List); !equalStrings(keys, []string{roleKey("editor", 5), roleKey("viewer", 5)}) {
+			t.Errorf("unexpected roles after grant : %v", keys)
+		}
+
+		// the list replaces the current roles, unknown roles are ignored
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "viewer", ObjectId: 5}, &pb.RoleRequest{Name: "unknown", ObjectId: 5})
+		if roles, err = server.ListUserRoles(ctx, &pb.UserId{Id: 7}); err != nil {
+			t.Fatal(err)
+		}
+		if keys := roleKeys(roles.List); !equalStrings(keys, []string{roleKey("viewer", 5)}) {
+			t.Errorf("unexpected roles after replace : %v", keys)
+		}
+
+		mustUpdateUser(t, server, 7)
+		if roles, err = server.ListUserRoles(ctx, &pb.UserId{Id: 7}); err != nil {
+			t.Fatal(err)
+		}
+		if len(roles.List) != 0 {
+			t.Errorf("unexpected roles after revoke : %v", roleKeys(roles.List))
+		}
+	})
+}
+
+func TestDeletedRoleRevoked(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_UPDATE)
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5})
+
+		mustUpdateRole(t, server, "editor", 5)
+		roles, err := server.ListUserRoles(context.Background(), &pb.UserId{Id: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roles.List) != 0 {
+			t.Errorf("user keeps deleted role : %v", roleKeys(roles.List))
+		}
+
+		// a new role with the same name is not granted
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_UPDATE)
+		if allowed(t, server, 7, 5, pb.RightAction_UPDATE) {
+			t.Error("recreated role granted to user")
+		}
+	})
+}
+
+func TestAuthQuery(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5})
+
+		if !allowed(t, server, 7, 5, pb.RightAction_UPDATE) {
+			t.Error("granted action refused")
+		}
+		if allowed(t, server, 7, 5, pb.RightAction_DELETE) {
+			t.Error("action not granted allowed")
+		}
+		if allowed(t, server, 7, 6, pb.RightAction_ACCESS) {
+			t.Error("action on other object allowed")
+		}
+		if allowed(t, server, 8, 5, pb.RightAction_ACCESS) {
+			t.Error("action allowed to user without role")
+		}
+	})
+}
+
+func TestAuthQueryAnonymous(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "guest", 5, pb.RightAction_ACCESS)
+		if allowed(t, server, 0, 5, pb.RightAction_ACCESS) {
+			t.Error("action allowed to anonymous user without role")
+		}
+
+		mustUpdateUser(t, server, 0, &pb.RoleRequest{Name: "guest", ObjectId: 5})
+		if !allowed(t, server, 0, 5, pb.RightAction_ACCESS) {
+			t.Error("action granted to anonymous user refused")
+		}
+	})
+}
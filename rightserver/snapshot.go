@@ -0,0 +1,518 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	pb "github.com/dvaumoron/puzzlerightservice"
+)
+
+// SnapshotVersion is the version of the format written by ExportSnapshot.
+const SnapshotVersion = 1
+
+const auditImport = "Import"
+
+type ImportMode uint8
+
+const (
+	// MergeImport adds and updates the roles and user roles, nothing is deleted.
+	MergeImport ImportMode = iota
+	// ReconcileImport is like MergeImport but the users in the snapshot lose their roles missing from it (like with UpdateUser).
+	ReconcileImport
+	// ReplaceImport also deletes the roles and the user roles missing from the snapshot.
+	ReplaceImport
+)
+
+// kinds of Change
+const (
+	CreateRoleChange = "create role"
+	UpdateRoleChange = "update role"
+	DeleteRoleChange = "delete role"
+	GrantChange      = "grant"
+	RevokeChange     = "revoke"
+)
+
+var (
+	errSnapshotVersion = errors.New("unsupported snapshot version")
+	errDuplicateRole   = errors.New("duplicate role in snapshot")
+	errNoAction        = errors.New("role without action in snapshot")
+	errUnknownAction   = errors.New("unknown action in snapshot")
+	errUnknownRole     = errors.New("unknown role granted in snapshot")
+)
+
+// Snapshot describes all the rights data, the roles are identified by their name and object
+// (not by database ids) to stay portable.
+type Snapshot struct {
+	Version int            `json:"version" yaml:"version"`
+	Roles   []SnapshotRole `json:"roles" yaml:"roles"`
+	Users   []SnapshotUser `json:"users" yaml:"users"`
+}
+
+type SnapshotRole struct {
+	Name     string   `json:"name" yaml:"name"`
+	ObjectId uint64   `json:"objectId" yaml:"objectId"`
+	Actions  []string `json:"actions" yaml:"actions"`
+}
+
+type SnapshotUser struct {
+	UserId uint64            `json:"userId" yaml:"userId"`
+	Roles  []SnapshotRoleRef `json:"roles" yaml:"roles"`
+}
+
+type SnapshotRoleRef struct {
+	Name     string `json:"name" yaml:"name"`
+	ObjectId uint64 `json:"objectId" yaml:"objectId"`
+}
+
+// Change is a modification made (or planned with a dry run) by ImportSnapshot.
+type Change struct {
+	Kind     string
+	UserId   uint64 // only for GrantChange and RevokeChange
+	Name     string
+	ObjectId uint64
+	Before   []string
+	After    []string
+}
+
+func (c Change) String() string {
+	var builder strings.Builder
+	builder.WriteString(c.Kind)
+	if c.Kind == GrantChange || c.Kind == RevokeChange {
+		fmt.Fprintf(&builder, " user %d", c.UserId)
+	}
+	fmt.Fprintf(&builder, " %q on object %d", c.Name, c.ObjectId)
+	if c.Kind == UpdateRoleChange {
+		fmt.Fprintf(&builder, " %v -> %v", c.Before, c.After)
+	} else if c.Kind == CreateRoleChange {
+		fmt.Fprintf(&builder, " %v", c.After)
+	}
+	return builder.String()
+}
+
+type roleKey struct {
+	name     string
+	objectId uint64
+}
+
+// ExportSnapshot reads the roles and the user roles in one transaction
+// (with Postgres, its isolation level must be at least repeatable read for them to be consistent).
+func ExportSnapshot(ctx context.Context, store Store) (snapshot Snapshot, err error) {
+	err = store.Transaction(ctx, func(tx Store) error {
+		var err error
+		snapshot, err = exportSnapshot(ctx, tx)
+		return err
+	})
+	return snapshot, err
+}
+
+func exportSnapshot(ctx context.Context, store Store) (Snapshot, error) {
+	roles, err := store.GetAllRoles(ctx)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	idToKey, err := loadRoleKeys(ctx, store, roles)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snapshotRoles := make([]SnapshotRole, 0, len(roles))
+	for _, role := range roles {
+		key := idToKey[role.Id]
+		snapshotRoles = append(snapshotRoles, SnapshotRole{
+			Name: key.name, ObjectId: key.objectId, Actions: convertActionNamesFromFlags(role.ActionFlags),
+		})
+	}
+	sort.Slice(snapshotRoles, func(i, j int) bool {
+		return lessRoleKey(snapshotRoles[i].ObjectId, snapshotRoles[i].Name, snapshotRoles[j].ObjectId, snapshotRoles[j].Name)
+	})
+
+	userRoles, err := store.GetAllUserRoles(ctx)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	userIdToRefs := map[uint64][]SnapshotRoleRef{}
+	for _, userRole := range userRoles {
+		if key, ok := idToKey[userRole.RoleId]; ok {
+			userIdToRefs[userRole.UserId] = append(userIdToRefs[userRole.UserId], SnapshotRoleRef{Name: key.name, ObjectId: key.objectId})
+		}
+	}
+
+	snapshotUsers := make([]SnapshotUser, 0, len(userIdToRefs))
+	for userId, refs := range userIdToRefs {
+		sort.Slice(refs, func(i, j int) bool {
+			return lessRoleKey(refs[i].ObjectId, refs[i].Name, refs[j].ObjectId, refs[j].Name)
+		})
+		snapshotUsers = append(snapshotUsers, SnapshotUser{UserId: userId, Roles: refs})
+	}
+	sort.Slice(snapshotUsers, func(i, j int) bool {
+		return snapshotUsers[i].UserId < snapshotUsers[j].UserId
+	})
+	return Snapshot{Version: SnapshotVersion, Roles: snapshotRoles, Users: snapshotUsers}, nil
+}
+
+// ImportSnapshot applies snapshot in one transaction (with the same audit as UpdateRole and UpdateUser),
+// with dryRun the changes are computed but nothing is modified.
+func ImportSnapshot(ctx context.Context, store Store, snapshot Snapshot, mode ImportMode, dryRun bool) ([]Change, error) {
+	if snapshot.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%w : %d", errSnapshotVersion, snapshot.Version)
+	}
+
+	keyToFlags, err := extractSnapshotFlags(snapshot.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	err = store.Transaction(ctx, func(tx Store) error {
+		im := importer{ctx: ctx, tx: tx, dryRun: dryRun, changes: []Change{}}
+		err := im.run(snapshot, keyToFlags, mode)
+		changes = im.changes
+		return err
+	})
+	return changes, err
+}
+
+type importer struct {
+	ctx     context.Context
+	tx      Store
+	dryRun  bool
+	changes []Change
+}
+
+func (im *importer) run(snapshot Snapshot, keyToFlags map[roleKey]uint8, mode ImportMode) error {
+	roles, err := im.tx.GetAllRoles(im.ctx)
+	if err != nil {
+		return err
+	}
+
+	idToKey, err := loadRoleKeys(im.ctx, im.tx, roles)
+	if err != nil {
+		return err
+	}
+
+	keyToRole := make(map[roleKey]model.Role, len(roles))
+	for _, role := range roles {
+		keyToRole[idToKey[role.Id]] = role
+	}
+
+	// read before any role deletion (the user roles would be deleted too)
+	userRoles, err := im.tx.GetAllUserRoles(im.ctx)
+	if err != nil {
+		return err
+	}
+
+	userIdToKeySet := map[uint64]map[roleKey]empty{}
+	for _, userRole := range userRoles {
+		if key, ok := idToKey[userRole.RoleId]; ok {
+			keySet := userIdToKeySet[userRole.UserId]
+			if keySet == nil {
+				keySet = map[roleKey]empty{}
+				userIdToKeySet[userRole.UserId] = keySet
+			}
+			keySet[key] = empty{}
+		}
+	}
+
+	for _, snapshotRole := range snapshot.Roles {
+		key := roleKey{name: snapshotRole.Name, objectId: snapshotRole.ObjectId}
+		if keyToRole[key], err = im.upsertRole(key, keyToRole[key], keyToFlags[key]); err != nil {
+			return err
+		}
+	}
+
+	if mode == ReplaceImport {
+		var deletedRoles []model.Role
+		for _, role := range roles {
+			key := idToKey[role.Id]
+			if _, ok := keyToFlags[key]; ok {
+				continue
+			}
+
+			if err = im.deleteRole(key, role); err != nil {
+				return err
+			}
+			delete(keyToRole, key)
+			deletedRoles = append(deletedRoles, role)
+		}
+
+		if len(deletedRoles) != 0 && !im.dryRun {
+			if _, err = im.tx.DeleteUnusedRoleNames(im.ctx); err != nil {
+				return err
+			}
+			if err = notifyDeletedNames(im.ctx, im.tx, deletedRoles); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, snapshotUser := range snapshot.Users {
+		userId := snapshotUser.UserId
+		if err = im.updateUser(userId, snapshotUser.Roles, userIdToKeySet[userId], keyToRole, mode != MergeImport); err != nil {
+			return err
+		}
+		delete(userIdToKeySet, userId)
+	}
+
+	if mode == ReplaceImport {
+		userIds := make([]uint64, 0, len(userIdToKeySet))
+		for userId := range userIdToKeySet {
+			userIds = append(userIds, userId)
+		}
+		sort.Slice(userIds, func(i, j int) bool {
+			return userIds[i] < userIds[j]
+		})
+
+		for _, userId := range userIds {
+			if err = im.updateUser(userId, nil, userIdToKeySet[userId], keyToRole, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// role has a zero Id when it does not exist yet
+func (im *importer) upsertRole(key roleKey, role model.Role, actionFlags uint8) (model.Role, error) {
+	ctx := im.ctx
+	if role.Id == 0 {
+		im.changes = append(im.changes, Change{
+			Kind: CreateRoleChange, Name: key.name, ObjectId: key.objectId, After: convertActionNamesFromFlags(actionFlags),
+		})
+		if im.dryRun {
+			return model.MakeRole(0, 0, key.objectId, actionFlags, 0), nil
+		}
+
+		if err := im.tx.CreateRoleName(ctx, model.MakeRoleName(0, key.name)); err != nil {
+			return role, err
+		}
+		roleName, err := im.tx.GetRoleNameByName(ctx, key.name)
+		if err != nil {
+			return role, err
+		}
+
+		created, err := im.tx.CreateRole(ctx, model.MakeRole(0, roleName.Id, key.objectId, actionFlags, 0))
+		if err != nil {
+			return role, err
+		}
+
+		// must retrieve the id
+		if role, err = im.tx.GetRoleByNameIdAndObjectId(ctx, roleName.Id, key.objectId); err != nil {
+			return role, err
+		}
+		if created {
+			return role, im.tx.CreateAuditEntry(ctx, auditImport, auditRoleKind, 0, key.objectId, key.name, 0, actionFlags)
+		}
+
+		// created by a concurrent call (like another instance applying the same configuration), update it instead
+		im.changes = im.changes[:len(im.changes)-1]
+	}
+
+	beforeFlags := role.ActionFlags
+	if beforeFlags == actionFlags {
+		return role, nil
+	}
+
+	im.changes = append(im.changes, Change{
+		Kind: UpdateRoleChange, Name: key.name, ObjectId: key.objectId,
+		Before: convertActionNamesFromFlags(beforeFlags), After: convertActionNamesFromFlags(actionFlags),
+	})
+	role.ActionFlags = actionFlags
+	if im.dryRun {
+		return role, nil
+	}
+
+	updated, err := im.tx.UpdateRole(ctx, role)
+	if err != nil {
+		return role, err
+	}
+	if !updated {
+		return role, errRoleConflict
+	}
+	role.Version++
+	return role, im.tx.CreateAuditEntry(ctx, auditImport, auditRoleKind, 0, key.objectId, key.name, beforeFlags, actionFlags)
+}
+
+func (im *importer) deleteRole(key roleKey, role model.Role) error {
+	im.changes = append(im.changes, Change{
+		Kind: DeleteRoleChange, Name: key.name, ObjectId: key.objectId, Before: convertActionNamesFromFlags(role.ActionFlags),
+	})
+	if im.dryRun {
+		return nil
+	}
+
+	if err := im.tx.DeleteRole(im.ctx, role); err != nil {
+		return err
+	}
+	return im.tx.CreateAuditEntry(im.ctx, auditImport, auditRoleKind, 0, key.objectId, key.name, role.ActionFlags, 0)
+}
+
+// grant the missing roles, and when replace is true revoke the ones not in refs
+func (im *importer) updateUser(userId uint64, refs []SnapshotRoleRef, currentKeySet map[roleKey]empty, keyToRole map[roleKey]model.Role, replace bool) error {
+	wantedKeys := make([]roleKey, 0, len(refs))
+	wantedKeySet := make(map[roleKey]empty, len(refs))
+	for _, ref := range refs {
+		key := roleKey{name: ref.Name, objectId: ref.ObjectId}
+		if _, ok := keyToRole[key]; !ok {
+			return fmt.Errorf("%w : %q on object %d for user %d", errUnknownRole, key.name, key.objectId, userId)
+		}
+		if _, ok := wantedKeySet[key]; !ok {
+			wantedKeySet[key] = empty{}
+			wantedKeys = append(wantedKeys, key)
+		}
+	}
+
+	revokedKeys := []roleKey{}
+	if replace {
+		for key := range currentKeySet {
+			if _, ok := wantedKeySet[key]; !ok {
+				revokedKeys = append(revokedKeys, key)
+			}
+		}
+		sort.Slice(revokedKeys, func(i, j int) bool {
+			return lessRoleKey(revokedKeys[i].objectId, revokedKeys[i].name, revokedKeys[j].objectId, revokedKeys[j].name)
+		})
+	}
+
+	grantedKeys := []roleKey{}
+	for _, key := range wantedKeys {
+		if _, ok := currentKeySet[key]; !ok {
+			grantedKeys = append(grantedKeys, key)
+		}
+	}
+
+	for _, key := range revokedKeys {
+		im.changes = append(im.changes, Change{Kind: RevokeChange, UserId: userId, Name: key.name, ObjectId: key.objectId})
+	}
+	for _, key := range grantedKeys {
+		im.changes = append(im.changes, Change{Kind: GrantChange, UserId: userId, Name: key.name, ObjectId: key.objectId})
+	}
+	if im.dryRun || len(revokedKeys)+len(grantedKeys) == 0 {
+		return nil
+	}
+
+	ctx := im.ctx
+	createdKeys := grantedKeys
+	if len(revokedKeys) != 0 {
+		// no deletion of a single user role, so all the wanted ones are recreated
+		if _, err := im.tx.DeleteUserRolesByUserId(ctx, userId); err != nil {
+			return err
+		}
+		createdKeys = wantedKeys
+	}
+
+	for _, key := range createdKeys {
+		if err := im.tx.CreateUserRole(ctx, model.MakeUserRole(0, userId, keyToRole[key].Id)); err != nil {
+			return err
+		}
+	}
+
+	// the revoked roles could have been deleted, so the flags are not always known
+	for _, key := range revokedKeys {
+		role := keyToRole[key]
+		if err := im.tx.CreateAuditEntry(ctx, auditImport, auditUserRoleKind, userId, key.objectId, key.name, role.ActionFlags, 0); err != nil {
+			return err
+		}
+	}
+	for _, key := range grantedKeys {
+		if err := im.tx.CreateAuditEntry(ctx, auditImport, auditUserRoleKind, userId, key.objectId, key.name, 0, keyToRole[key].ActionFlags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// map the role ids to their name and object
+func loadRoleKeys(ctx context.Context, store Store, roles []model.Role) (map[uint64]roleKey, error) {
+	nameIdSet := map[uint64]empty{}
+	for _, role := range roles {
+		nameIdSet[role.NameId] = empty{}
+	}
+
+	idToKey := make(map[uint64]roleKey, len(roles))
+	if len(nameIdSet) == 0 {
+		return idToKey, nil
+	}
+
+	nameIds := make([]uint64, 0, len(nameIdSet))
+	for nameId := range nameIdSet {
+		nameIds = append(nameIds, nameId)
+	}
+
+	roleNames, err := store.GetRoleNamesByIds(ctx, nameIds)
+	if err != nil {
+		return nil, err
+	}
+
+	idToName := make(map[uint64]string, len(roleNames))
+	for _, roleName := range roleNames {
+		idToName[roleName.Id] = roleName.Name
+	}
+	for _, role := range roles {
+		idToKey[role.Id] = roleKey{name: idToName[role.NameId], objectId: role.ObjectId}
+	}
+	return idToKey, nil
+}
+
+func extractSnapshotFlags(snapshotRoles []SnapshotRole) (map[roleKey]uint8, error) {
+	keyToFlags := make(map[roleKey]uint8, len(snapshotRoles))
+	for _, snapshotRole := range snapshotRoles {
+		key := roleKey{name: snapshotRole.Name, objectId: snapshotRole.ObjectId}
+		if _, ok := keyToFlags[key]; ok {
+			return nil, fmt.Errorf("%w : %q on object %d", errDuplicateRole, key.name, key.objectId)
+		}
+
+		var actionFlags uint8
+		for _, actionName := range snapshotRole.Actions {
+			action, ok := pb.RightAction_value[strings.ToUpper(actionName)]
+			if !ok {
+				return nil, fmt.Errorf("%w : %s", errUnknownAction, actionName)
+			}
+			actionFlags |= convertActionToFlag(pb.RightAction(action))
+		}
+		if actionFlags == 0 {
+			return nil, fmt.Errorf("%w : %q on object %d", errNoAction, key.name, key.objectId)
+		}
+		keyToFlags[key] = actionFlags
+	}
+	return keyToFlags, nil
+}
+
+func convertActionNamesFromFlags(actionFlags uint8) []string {
+	actions := convertActionsFromFlags(actionFlags)
+	actionNames := make([]string, 0, len(actions))
+	for _, action := range actions {
+		actionNames = append(actionNames, action.String())
+	}
+	return actionNames
+}
+
+func lessRoleKey(objectId1 uint64, name1 string, objectId2 uint64, name2 string) bool {
+	if objectId1 == objectId2 {
+		return name1 < name2
+	}
+	return objectId1 < objectId2
+}
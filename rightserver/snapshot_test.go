@@ -0,0 +1,242 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	pb "github.com/dvaumoron/puzzlerightservice"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errOutsideTransaction = errors.New("read outside of a transaction")
+
+// txOnlyStore refuses the reads made outside of a transaction
+type txOnlyStore struct {
+	rightserver.Store
+}
+
+func (txOnlyStore) GetAllRoles(ctx context.Context) ([]model.Role, error) {
+	return nil, errOutsideTransaction
+}
+
+func (txOnlyStore) GetAllUserRoles(ctx context.Context) ([]model.UserRole, error) {
+	return nil, errOutsideTransaction
+}
+
+func TestExportSnapshot(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		mustUpdateRole(t, server, "reader", 5, pb.RightAction_ACCESS)
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+		mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5})
+
+		snapshot, err := rightserver.ExportSnapshot(context.Background(), txOnlyStore{Store: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if snapshot.Version != rightserver.SnapshotVersion {
+			t.Errorf("unexpected version : %d", snapshot.Version)
+		}
+		roleNames := make([]string, 0, len(snapshot.Roles))
+		for _, role := range snapshot.Roles {
+			roleNames = append(roleNames, roleKey(role.Name, role.ObjectId))
+		}
+		if !equalStrings(roleNames, []string{roleKey("editor", 5), roleKey("reader", 5)}) {
+			t.Errorf("unexpected roles : %v", roleNames)
+		}
+		if len(snapshot.Users) != 1 || snapshot.Users[0].UserId != 7 || len(snapshot.Users[0].Roles) != 1 || snapshot.Users[0].Roles[0].Name != "editor" {
+			t.Errorf("unexpected users : %+v", snapshot.Users)
+		}
+	})
+}
+
+// "kind:name@objectId" (with ":userId" for user changes) sorted
+func changeKeys(changes []rightserver.Change) []string {
+	keys := make([]string, 0, len(changes))
+	for _, change := range changes {
+		key := change.Kind + ":" + roleKey(change.Name, change.ObjectId)
+		if change.Kind == rightserver.GrantChange || change.Kind == rightserver.RevokeChange {
+			key += ":" + strconv.FormatUint(change.UserId, 10)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// editor on 5 and reader on 6, user 7 has both and user 8 has reader
+func setupImport(t *testing.T, server pb.RightServer) {
+	mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS, pb.RightAction_UPDATE)
+	mustUpdateRole(t, server, "reader", 6, pb.RightAction_ACCESS)
+	mustUpdateUser(t, server, 7, &pb.RoleRequest{Name: "editor", ObjectId: 5}, &pb.RoleRequest{Name: "reader", ObjectId: 6})
+	mustUpdateUser(t, server, 8, &pb.RoleRequest{Name: "reader", ObjectId: 6})
+}
+
+// editor loses UPDATE, reader is missing and viewer is new
+var replaceSnapshot = rightserver.Snapshot{
+	Version: rightserver.SnapshotVersion,
+	Roles: []rightserver.SnapshotRole{
+		{Name: "editor", ObjectId: 5, Actions: []string{"ACCESS"}},
+		{Name: "viewer", ObjectId: 7, Actions: []string{"ACCESS"}},
+	},
+	Users: []rightserver.SnapshotUser{{UserId: 9, Roles: []rightserver.SnapshotRoleRef{{Name: "viewer", ObjectId: 7}}}},
+}
+
+func TestImportSnapshotReplace(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		setupImport(t, server)
+
+		// reader is only used on object 6
+		expectedPayloads := []string{namePayload(t, store, "reader")}
+
+		var payloads []string
+		changes, err := rightserver.ImportSnapshot(context.Background(), notifyRecorder{Store: store, payloads: &payloads}, replaceSnapshot, rightserver.ReplaceImport, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(payloads, expectedPayloads) {
+			t.Errorf("expected notifications %v, got %v", expectedPayloads, payloads)
+		}
+		expected := []string{
+			"create role:viewer@7", "delete role:reader@6", "grant:viewer@7:9", "revoke:editor@5:7",
+			"revoke:reader@6:7", "revoke:reader@6:8", "update role:editor@5",
+		}
+		if keys := changeKeys(changes); !equalStrings(keys, expected) {
+			t.Errorf("expected %v, got %v", expected, keys)
+		}
+
+		if keys := listRoleKeys(t, server, 5, 6, 7); !equalStrings(keys, []string{roleKey("editor", 5), roleKey("viewer", 7)}) {
+			t.Errorf("unexpected roles : %v", keys)
+		}
+		if actions := roleActions(t, server, "editor", 5); !equalActions(actions, pb.RightAction_ACCESS) {
+			t.Errorf("unexpected actions : %v", actions)
+		}
+		// the users missing from the snapshot lose all their roles
+		for userId, expected := range map[uint64][]string{7: nil, 8: nil, 9: {roleKey("viewer", 7)}} {
+			if keys := userRoleKeys(t, server, userId); !equalStrings(keys, expected) {
+				t.Errorf("unexpected roles for user %d : %v", userId, keys)
+			}
+		}
+	})
+}
+
+func TestImportSnapshotDryRun(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		server := newTestServer(t, store)
+		ctx := context.Background()
+		setupImport(t, server)
+		before, err := rightserver.ExportSnapshot(ctx, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		planned, err := rightserver.ImportSnapshot(ctx, store, replaceSnapshot, rightserver.ReplaceImport, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := rightserver.ExportSnapshot(ctx, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("dry run modified the data : %+v", after)
+		}
+
+		// the same changes are made without dry run
+		changes, err := rightserver.ImportSnapshot(ctx, store, replaceSnapshot, rightserver.ReplaceImport, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plannedKeys, keys := changeKeys(planned), changeKeys(changes); !equalStrings(plannedKeys, keys) {
+			t.Errorf("planned %v, made %v", plannedKeys, keys)
+		}
+	})
+}
+
+var managedSnapshot = rightserver.Snapshot{
+	Version: rightserver.SnapshotVersion,
+	Roles:   []rightserver.SnapshotRole{{Name: "editor", ObjectId: 5, Actions: []string{"ACCESS", "UPDATE"}}},
+	Users:   []rightserver.SnapshotUser{{UserId: 7, Roles: []rightserver.SnapshotRoleRef{{Name: "editor", ObjectId: 5}}}},
+}
+
+// with RIGHTS_CONFIG_REJECT=true
+func TestManagedReject(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		managed := rightserver.NewManaged(true)
+		server := newCustomTestServer(t, store, managed, rightserver.NewNameCache())
+		ctx := context.Background()
+		if _, err := managed.Reconcile(ctx, store, managedSnapshot); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := server.UpdateRole(ctx, &pb.Role{Name: "editor", ObjectId: 5, List: []pb.RightAction{pb.RightAction_ACCESS}})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected FailedPrecondition for a managed role, got %v", err)
+		}
+		_, err = server.UpdateUser(ctx, &pb.UserRight{UserId: 7})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected FailedPrecondition for a managed user, got %v", err)
+		}
+
+		if actions := roleActions(t, server, "editor", 5); !equalActions(actions, pb.RightAction_ACCESS, pb.RightAction_UPDATE) {
+			t.Errorf("managed role modified : %v", actions)
+		}
+		if keys := userRoleKeys(t, server, 7); !equalStrings(keys, []string{roleKey("editor", 5)}) {
+			t.Errorf("managed user modified : %v", keys)
+		}
+
+		// the others are still updatable
+		mustUpdateRole(t, server, "editor", 6, pb.RightAction_ACCESS)
+		mustUpdateUser(t, server, 8, &pb.RoleRequest{Name: "editor", ObjectId: 5})
+	})
+}
+
+// without RIGHTS_CONFIG_REJECT, the updates are only logged (and undone by the next reconciliation)
+func TestManagedAllow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store rightserver.Store) {
+		managed := rightserver.NewManaged(false)
+		server := newCustomTestServer(t, store, managed, rightserver.NewNameCache())
+		ctx := context.Background()
+		if _, err := managed.Reconcile(ctx, store, managedSnapshot); err != nil {
+			t.Fatal(err)
+		}
+
+		mustUpdateRole(t, server, "editor", 5, pb.RightAction_ACCESS)
+		mustUpdateUser(t, server, 7)
+
+		changes, err := managed.Reconcile(ctx, store, managedSnapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, expected := changeKeys(changes), []string{"grant:editor@5:7", "update role:editor@5"}; !equalStrings(keys, expected) {
+			t.Errorf("expected the drift %v, got %v", expected, keys)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+//go:build cgo
+
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dvaumoron/puzzlerightserver/migration"
+	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	"github.com/dvaumoron/puzzlerightserver/sqlite"
+	pb "github.com/dvaumoron/puzzlerightservice"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	storeFactories = append(storeFactories, storeFactory{name: "sqlite", newStore: newSQLiteStore})
+}
+
+// a new migrated database file for each test
+func newSQLiteStore(t testing.TB) rightserver.Store {
+	return rightserver.NewSQLStore(openSQLiteDB(t), sqlite.IsRetryable, sql.LevelDefault, "")
+}
+
+func openSQLiteDB(t testing.TB) *sql.DB {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "rights.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	migrator, err := migration.New(db, migration.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// there is no write operation for attributes and objects in Store
+func TestSQLiteGetAuthData(t *testing.T) {
+	db := openSQLiteDB(t)
+	store := rightserver.NewSQLStore(db, sqlite.IsRetryable, sql.LevelDefault, "")
+	ctx := context.Background()
+	for _, query := range []string{
+		"insert into user_attributes(user_id, name, value) values(7, 'country', 'fr');",
+		"insert into objects(object_id, object_type, name) values(5, 'forum', 'general');",
+		"insert into object_attributes(object_id, name, value) values(5, 'open', 'yes');",
+	} {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := store.GetAuthData(ctx, 7, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.UserAttributes) != 1 || data.UserAttributes[0].Value != "fr" {
+		t.Errorf("unexpected user attributes : %v", data.UserAttributes)
+	}
+	if !data.ObjectFound || data.Object.ObjectType != "forum" {
+		t.Errorf("unexpected object : %v", data.Object)
+	}
+	if len(data.ObjectAttributes) != 1 || data.ObjectAttributes[0].Name != "open" {
+		t.Errorf("unexpected object attributes : %v", data.ObjectAttributes)
+	}
+
+	if data, err = store.GetAuthData(ctx, 8, 6); err != nil {
+		t.Fatal(err)
+	}
+	if data.ObjectFound || len(data.UserAttributes) != 0 {
+		t.Errorf("unexpected data for unknown user and object : %+v", data)
+	}
+}
+
+// "rpc:kind:userId:roleName" in id order
+func auditRows(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.QueryContext(context.Background(), "select rpc, kind, user_id, role_name from audit_entries order by id;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var entries []string
+	for rows.Next() {
+		var rpc, kind, roleName string
+		var userId uint64
+		if err = rows.Scan(&rpc, &kind, &userId, &roleName); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, rpc+":"+kind+":"+strconv.FormatUint(userId, 10)+":"+roleName)
+	}
+	return entries
+}
+
+// a role change and a grant to the anonymous user both have a zero user_id, the kind tells them apart
+func TestSQLiteAuditKind(t *testing.T) {
+	db := openSQLiteDB(t)
+	server := newTestServer(t, rightserver.NewSQLStore(db, sqlite.IsRetryable, sql.LevelDefault, ""))
+	mustUpdateRole(t, server, "guest", 5, pb.RightAction_ACCESS)
+	mustUpdateUser(t, server, 0, &pb.RoleRequest{Name: "guest", ObjectId: 5})
+
+	if entries, expected := auditRows(t, db), []string{"UpdateRole:role:0:guest", "UpdateUser:user_role:0:guest"}; !equalStrings(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+}
+
+func TestSQLiteAuditRefused(t *testing.T) {
+	db := openSQLiteDB(t)
+	server := newTestServer(t, rightserver.NewSQLStore(db, sqlite.IsRetryable, sql.LevelDefault, ""))
+	request := &pb.Role{Name: "admin", ObjectId: protectedObjectId, List: []pb.RightAction{pb.RightAction_ACCESS}}
+	if _, err := server.UpdateRole(context.Background(), request); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+
+	if entries, expected := auditRows(t, db), []string{"UpdateRole:refused_role:0:admin"}; !equalStrings(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+}
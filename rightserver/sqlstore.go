@@ -0,0 +1,273 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+)
+
+// interface allowing *sql.DB or *sql.Tx
+type sqlPool interface {
+	model.ExecerContext
+	model.QueryerContext
+	model.RowQueryerContext
+}
+
+const maxTxAttempts = 3
+
+// Postgres only (NOTIFY does not accept parameters)
+const notifyQuery = "select pg_notify($1, $2);"
+
+type sqlStore struct {
+	db            *sql.DB
+	pool          sqlPool
+	retryable     func(error) bool
+	txOptions     *sql.TxOptions
+	notifyChannel string
+}
+
+// NewSQLStore returns a Store using the queries of the model package,
+// retryable tells which errors come from a conflict with a concurrent transaction,
+// isolation is the level used by the transactions (sql.LevelDefault to keep the one of the database)
+// and notifyChannel is the Postgres channel used by Notify (empty to disable the notifications).
+func NewSQLStore(db *sql.DB, retryable func(error) bool, isolation sql.IsolationLevel, notifyChannel string) Store {
+	return sqlStore{
+		db: db, pool: db, retryable: retryable, txOptions: &sql.TxOptions{Isolation: isolation}, notifyChannel: notifyChannel,
+	}
+}
+
+func (s sqlStore) GetAllRoles(ctx context.Context) ([]model.Role, error) {
+	return model.GetAllRoles(s.pool, ctx)
+}
+
+func (s sqlStore) GetRolesByUserId(ctx context.Context, userId uint64) ([]model.Role, error) {
+	return model.GetRolesByUserId(s.pool, ctx, userId)
+}
+
+func (s sqlStore) GetRolesByObjectIds(ctx context.Context, objectIds []uint64) ([]model.Role, error) {
+	return model.GetRolesByObjectIds(s.pool, ctx, objectIds)
+}
+
+func (s sqlStore) GetRoleByNameAndObjectId(ctx context.Context, name string, objectId uint64) (model.Role, error) {
+	return model.GetRoleByNameAndObjectId(s.pool, ctx, name, objectId)
+}
+
+func (s sqlStore) GetRoleByNameIdAndObjectId(ctx context.Context, nameId uint64, objectId uint64) (model.Role, error) {
+	return model.GetRoleByNameIdAndObjectId(s.pool, ctx, nameId, objectId)
+}
+
+func (s sqlStore) GetRolesByNamesAndObjectIds(ctx context.Context, nameToObjectIds map[string][]uint64) ([]model.Role, error) {
+	resRoles := []model.Role{}
+	for name, objectIds := range nameToObjectIds {
+		roles, err := model.GetRolesByNameAndObjectIds(s.pool, ctx, name, objectIds)
+		if err != nil {
+			return nil, err
+		}
+		resRoles = append(resRoles, roles...)
+	}
+	return resRoles, nil
+}
+
+func (s sqlStore) CreateRole(ctx context.Context, role model.Role) (bool, error) {
+	created, err := model.CreateRoleIfAbsent(s.pool, ctx, role.NameId, role.ObjectId, role.ActionFlags)
+	return created != 0, err
+}
+
+func (s sqlStore) UpdateRole(ctx context.Context, role model.Role) (bool, error) {
+	updated, err := model.UpdateRoleActionFlags(s.pool, ctx, role.Id, role.ActionFlags, role.Version)
+	if err == nil && updated == 0 {
+		// the role was modified since it was read, the transaction will read it again
+		if pool, inTx := s.pool.(txPool); inTx {
+			*pool.conflict = true
+		}
+	}
+	return updated != 0, err
+}
+
+// the user roles are deleted explicitly, the schema may not cascade (hand-written before the migrations)
+func (s sqlStore) DeleteRole(ctx context.Context, role model.Role) error {
+	if _, err := model.DeleteUserRolesByRoleId(s.pool, ctx, role.Id); err != nil {
+		return err
+	}
+	return role.Delete(s.pool, ctx)
+}
+
+// the user roles are deleted first to count them
+func (s sqlStore) DeleteRolesByObjectIds(ctx context.Context, objectIds []uint64) (int64, int64, error) {
+	userRoleCount, err := model.DeleteUserRolesByObjectIds(s.pool, ctx, objectIds)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	roleCount, err := model.DeleteRolesByObjectIds(s.pool, ctx, objectIds)
+	return roleCount, userRoleCount, err
+}
+
+func (s sqlStore) GetRoleNameByName(ctx context.Context, name string) (model.RoleName, error) {
+	return model.GetRoleNameByName(s.pool, ctx, name)
+}
+
+func (s sqlStore) GetRoleNamesByIds(ctx context.Context, ids []uint64) ([]model.RoleName, error) {
+	return model.GetRoleNamesByIds(s.pool, ctx, ids)
+}
+
+func (s sqlStore) CreateRoleName(ctx context.Context, roleName model.RoleName) error {
+	_, err := model.CreateRoleNameIfAbsent(s.pool, ctx, roleName.Name)
+	return err
+}
+
+func (s sqlStore) UpdateRoleName(ctx context.Context, roleName model.RoleName) error {
+	return roleName.Update(s.pool, ctx)
+}
+
+func (s sqlStore) DeleteUnusedRoleNames(ctx context.Context) (int64, error) {
+	return model.DeleteUnusedRoleNames(s.pool, ctx)
+}
+
+func (s sqlStore) GetAllUserRoles(ctx context.Context) ([]model.UserRole, error) {
+	return model.GetAllUserRoles(s.pool, ctx)
+}
+
+func (s sqlStore) CreateUserRole(ctx context.Context, userRole model.UserRole) error {
+	return userRole.Create(s.pool, ctx)
+}
+
+func (s sqlStore) DeleteUserRolesByUserId(ctx context.Context, userId uint64) (int64, error) {
+	return model.DeleteUserRolesByUserId(s.pool, ctx, userId)
+}
+
+// the queries share a connection (the one of the transaction when there is one)
+func (s sqlStore) GetAuthData(ctx context.Context, userId uint64, objectId uint64) (AuthData, error) {
+	pool := s.pool
+	if _, inTx := pool.(txPool); !inTx {
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return AuthData{}, err
+		}
+		defer conn.Close()
+		pool = conn
+	}
+
+	var data AuthData
+	var err error
+	if data.Roles, err = model.GetRolesByUserId(pool, ctx, userId); err != nil {
+		return data, err
+	}
+	if data.UserAttributes, err = model.GetUserAttributesByUserId(pool, ctx, userId); err != nil {
+		return data, err
+	}
+
+	if data.Object, err = model.GetObjectByObjectId(pool, ctx, objectId); err != nil {
+		if err == sql.ErrNoRows {
+			return data, nil
+		}
+		return data, err
+	}
+	data.ObjectFound = true
+	data.ObjectAttributes, err = model.GetObjectAttributesByObjectId(pool, ctx, objectId)
+	return data, err
+}
+
+func (s sqlStore) CreateAuditEntry(ctx context.Context, rpc string, kind string, userId uint64, objectId uint64, roleName string, beforeFlags uint8, afterFlags uint8) error {
+	_, err := model.CreateAuditEntry(s.pool, ctx, rpc, kind, userId, objectId, roleName, beforeFlags, afterFlags)
+	return err
+}
+
+func (s sqlStore) Notify(ctx context.Context, payload string) error {
+	if s.notifyChannel == "" {
+		return nil
+	}
+
+	_, err := s.pool.ExecContext(ctx, notifyQuery, s.notifyChannel, payload)
+	return err
+}
+
+func (s sqlStore) Transaction(ctx context.Context, f func(Store) error) (err error) {
+	if _, inTx := s.pool.(txPool); inTx {
+		return f(s)
+	}
+
+	for attempt := 1; ; attempt++ {
+		var conflict bool
+		err = s.runTransaction(ctx, f, &conflict)
+		if err == nil || !conflict || attempt == maxTxAttempts {
+			return err
+		}
+	}
+}
+
+func (s sqlStore) runTransaction(ctx context.Context, f func(Store) error, conflict *bool) (err error) {
+	tx, err := s.db.BeginTx(ctx, s.txOptions)
+	if err != nil {
+		return err
+	}
+
+	pool := txPool{Tx: tx, retryable: s.retryable, conflict: conflict}
+	defer pool.commitOrRollBack(&err)
+
+	return f(sqlStore{db: s.db, pool: pool, retryable: s.retryable, txOptions: s.txOptions, notifyChannel: s.notifyChannel})
+}
+
+// txPool watches the errors to know if the transaction failed because of a concurrent one
+type txPool struct {
+	*sql.Tx
+	retryable func(error) bool
+	conflict  *bool
+}
+
+func (p txPool) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	result, err := p.Tx.ExecContext(ctx, query, args...)
+	p.check(err)
+	return result, err
+}
+
+func (p txPool) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := p.Tx.QueryContext(ctx, query, args...)
+	p.check(err)
+	return rows, err
+}
+
+func (p txPool) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	row := p.Tx.QueryRowContext(ctx, query, args...)
+	p.check(row.Err())
+	return row
+}
+
+// a failed commit is reported and can also come from a conflict (like a serialization failure)
+func (p txPool) commitOrRollBack(err *error) {
+	if r := recover(); r != nil {
+		p.Tx.Rollback()
+		*err = fmt.Errorf("recovered in transaction : %v", r)
+	} else if *err == nil {
+		*err = p.Tx.Commit()
+		p.check(*err)
+	} else {
+		p.Tx.Rollback()
+	}
+}
+
+func (p txPool) check(err error) {
+	if err != nil && p.retryable(err) {
+		*p.conflict = true
+	}
+}
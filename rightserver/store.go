@@ -0,0 +1,96 @@
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rightserver
+
+import (
+	"context"
+
+	"github.com/dvaumoron/puzzlerightserver/model"
+)
+
+// AuthData contains the roles and attributes of a user and the description of an object,
+// ObjectFound is false when the object is not registered.
+type AuthData struct {
+	Roles            []model.Role
+	UserAttributes   []model.UserAttribute
+	ObjectFound      bool
+	Object           model.Object
+	ObjectAttributes []model.ObjectAttribute
+}
+
+// kinds of audit entries
+const (
+	auditRoleKind     = "role"
+	auditUserRoleKind = "user_role"
+	// changes refused by the server (protected object or managed by the configuration)
+	auditRefusedRoleKind = "refused_role"
+	auditRefusedUserKind = "refused_user"
+)
+
+// Store gives access to the persisted rights data.
+//
+// Getters returning a single value return sql.ErrNoRows when nothing match.
+type Store interface {
+	GetAllRoles(ctx context.Context) ([]model.Role, error)
+	GetRolesByUserId(ctx context.Context, userId uint64) ([]model.Role, error)
+	GetRolesByObjectIds(ctx context.Context, objectIds []uint64) ([]model.Role, error)
+	GetRoleByNameAndObjectId(ctx context.Context, name string, objectId uint64) (model.Role, error)
+	GetRoleByNameIdAndObjectId(ctx context.Context, nameId uint64, objectId uint64) (model.Role, error)
+	// GetRolesByNamesAndObjectIds returns the roles matching a name and one of its object ids.
+	GetRolesByNamesAndObjectIds(ctx context.Context, nameToObjectIds map[string][]uint64) ([]model.Role, error)
+	// CreateRole does nothing and returns false when a role with the same name and object already exists.
+	CreateRole(ctx context.Context, role model.Role) (bool, error)
+	// UpdateRole saves the action flags and increments the version of the role,
+	// the returned boolean is false when the role version no longer match (concurrent modification),
+	// inside a transaction this also makes it retried (the clients do not send the version they read).
+	UpdateRole(ctx context.Context, role model.Role) (bool, error)
+	// DeleteRole also delete the user roles linked to the deleted role.
+	DeleteRole(ctx context.Context, role model.Role) error
+	// DeleteRolesByObjectIds deletes the roles on the objects and their user roles,
+	// it returns the numbers of deleted roles and user roles.
+	DeleteRolesByObjectIds(ctx context.Context, objectIds []uint64) (int64, int64, error)
+
+	GetRoleNameByName(ctx context.Context, name string) (model.RoleName, error)
+	GetRoleNamesByIds(ctx context.Context, ids []uint64) ([]model.RoleName, error)
+	// CreateRoleName does nothing when the name already exists.
+	CreateRoleName(ctx context.Context, roleName model.RoleName) error
+	UpdateRoleName(ctx context.Context, roleName model.RoleName) error
+	DeleteUnusedRoleNames(ctx context.Context) (int64, error)
+
+	GetAllUserRoles(ctx context.Context) ([]model.UserRole, error)
+	CreateUserRole(ctx context.Context, userRole model.UserRole) error
+	DeleteUserRolesByUserId(ctx context.Context, userId uint64) (int64, error)
+
+	// GetAuthData loads everything AuthQuery needs with a single connection.
+	GetAuthData(ctx context.Context, userId uint64, objectId uint64) (AuthData, error)
+
+	// CreateAuditEntry records a change of kind auditRoleKind or auditUserRoleKind (userId is only meaningful for the latter),
+	// or its refusal.
+	CreateAuditEntry(ctx context.Context, rpc string, kind string, userId uint64, objectId uint64, roleName string, beforeFlags uint8, afterFlags uint8) error
+
+	// Notify sends payload to the other instances sharing the data (once the transaction is committed),
+	// it does nothing when notifications are not enabled.
+	Notify(ctx context.Context, payload string) error
+
+	// Transaction calls f with a Store bound to a transaction,
+	// committed when f returns nil and rolled back otherwise (or when f panics).
+	// f can be called again when the transaction failed because of a concurrent one.
+	// Inside a transaction, Transaction reuses the current one.
+	Transaction(ctx context.Context, f func(Store) error) error
+}
@@ -19,22 +19,52 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	_ "embed"
+	"errors"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	grpcserver "github.com/dvaumoron/puzzlegrpcserver"
+	"github.com/dvaumoron/puzzlerightserver/migration"
+	"github.com/dvaumoron/puzzlerightserver/postgres"
 	"github.com/dvaumoron/puzzlerightserver/rightserver"
+	"github.com/dvaumoron/puzzlerightserver/sqlite"
 	pb "github.com/dvaumoron/puzzlerightservice"
+	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
 	"go.uber.org/zap"
 )
 
 //go:embed version.txt
 var version string
 
+var errUnknownIsolationLevel = errors.New("unknown transaction isolation level")
+
+const (
+	// the public part (object 0) stay protected when nothing is configured
+	defaultProtectedObjectIds = "0"
+
+	sqliteScheme = "sqlite://"
+	memoryAddr   = "memory://"
+
+	// how long the reads of a caller go to the primary after its writes
+	defaultReplicaWindow = 5 * time.Second
+)
+
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	// should start with this, to benefit from the call to godotenv
 	ctx, initSpan, s := grpcserver.Init(rightserver.RightKey, version)
 
@@ -52,14 +82,216 @@ func main() {
 	if err != nil {
 		s.Logger.FatalContext(ctx, "Failed to initialize OPA module", zap.Error(err))
 	}
-	initSpan.End()
 
-	db, err := sql.Open("pgx", os.Getenv("DB_SERVER_ADDR"))
+	protectedObjectIds, err := parseObjectIds(os.Getenv("PROTECTED_OBJECT_IDS"))
 	if err != nil {
-		s.Logger.FatalContext(ctx, "Failed to initialize DB", zap.Error(err))
+		s.Logger.FatalContext(ctx, "Failed to parse protected object ids", zap.Error(err))
+	}
+	initSpan.End()
+
+	names := rightserver.NewNameCache()
+	var store rightserver.Store
+	if os.Getenv("DB_SERVER_ADDR") == memoryAddr {
+		s.Logger.WarnContext(ctx, "Rights are kept in memory and will be lost on shutdown")
+		store = rightserver.NewMemoryStore()
+	} else {
+		db, dialect, err := openDB(os.Getenv("DB_SERVER_ADDR"))
+		if err != nil {
+			s.Logger.FatalContext(ctx, "Failed to initialize DB", zap.Error(err))
+		}
+		defer db.Close()
+
+		if os.Getenv("DB_AUTO_MIGRATE") == "true" {
+			migrator, err := migration.New(db, dialect)
+			if err != nil {
+				s.Logger.FatalContext(ctx, "Failed to load migrations", zap.Error(err))
+			}
+
+			applied, err := migrator.Up(ctx)
+			for _, appliedMigration := range applied {
+				s.Logger.InfoContext(ctx, "Applied migration", zap.Uint64("version", appliedMigration.Version), zap.String("name", appliedMigration.Name))
+			}
+			if err != nil {
+				s.Logger.FatalContext(ctx, "Failed to migrate DB", zap.Error(err))
+			}
+		}
+		isolation, err := parseIsolationLevel(os.Getenv("DB_TX_ISOLATION"))
+		if err != nil {
+			s.Logger.FatalContext(ctx, "Failed to parse transaction isolation level", zap.Error(err))
+		}
+
+		retryable := retryableFor(dialect)
+		nativePgx := dialect == migration.Postgres && os.Getenv("DB_NATIVE_PGX") == "true"
+
+		notifyChannel := notifyChannelFor(dialect)
+		store, err = newSQLStore(ctx, db, os.Getenv("DB_SERVER_ADDR"), nativePgx, retryable, isolation, notifyChannel)
+		if err != nil {
+			s.Logger.FatalContext(ctx, "Failed to initialize pgx pool", zap.Error(err))
+		}
+
+		if notifyChannel != "" {
+			go postgres.Listen(context.Background(), os.Getenv("DB_SERVER_ADDR"), notifyChannel, names.HandleNotification, func() {
+				s.Logger.InfoContext(ctx, "Notification listener reconnected, name cache flushed")
+				names.Flush()
+			}, func(err error) {
+				s.Logger.ErrorContext(ctx, "Notification listener failed", zap.Error(err))
+			})
+		}
+
+		if replicaAddr := os.Getenv("DB_REPLICA_ADDR"); replicaAddr != "" {
+			replicaDB, _, err := openDB(replicaAddr)
+			if err != nil {
+				s.Logger.FatalContext(ctx, "Failed to initialize replica DB", zap.Error(err))
+			}
+			defer replicaDB.Close()
+
+			window, err := parseDuration(os.Getenv("DB_REPLICA_WINDOW"), defaultReplicaWindow)
+			if err != nil {
+				s.Logger.FatalContext(ctx, "Failed to parse replica window", zap.Error(err))
+			}
+
+			// no write, so no notification
+			replicaStore, err := newSQLStore(ctx, replicaDB, replicaAddr, nativePgx, retryable, isolation, "")
+			if err != nil {
+				s.Logger.FatalContext(ctx, "Failed to initialize replica pgx pool", zap.Error(err))
+			}
+			store = rightserver.NewReplicaStore(store, replicaStore, window)
+		}
+	}
+
+	managed := rightserver.NewManaged(os.Getenv("RIGHTS_CONFIG_REJECT") == "true")
+	if configPath := os.Getenv("RIGHTS_CONFIG_FILE"); configPath != "" {
+		if err := reconcileConfig(ctx, s.Logger, managed, store, configPath); err != nil {
+			s.Logger.FatalContext(ctx, "Failed to apply rights configuration", zap.Error(err))
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				if err := reconcileConfig(ctx, s.Logger, managed, store, configPath); err != nil {
+					s.Logger.ErrorContext(ctx, "Failed to apply rights configuration", zap.Error(err))
+				}
+			}
+		}()
 	}
-	defer db.Close()
 
-	pb.RegisterRightServer(s, rightserver.New(db, query, s.Logger))
+	pb.RegisterRightServer(s, rightserver.New(store, protectedObjectIds, managed, names, query, s.Logger))
 	s.Start(ctx)
 }
+
+// return the database and its dialect, chosen from the scheme of dbAddr
+func openDB(dbAddr string) (*sql.DB, string, error) {
+	dialect := dialectFor(dbAddr)
+	if dialect == migration.SQLite {
+		db, err := sqlite.Open(strings.TrimPrefix(dbAddr, sqliteScheme))
+		return db, dialect, err
+	}
+
+	db, err := sql.Open("pgx", dbAddr)
+	return db, dialect, err
+}
+
+func dialectFor(dbAddr string) string {
+	if strings.HasPrefix(dbAddr, sqliteScheme) {
+		return migration.SQLite
+	}
+	return migration.Postgres
+}
+
+// the other instances are notified of the changes through Postgres,
+// an empty channel means they are not (and keep the role names they cached)
+func notifyChannelFor(dialect string) string {
+	if dialect != migration.Postgres {
+		return ""
+	}
+	return os.Getenv("DB_NOTIFY_CHANNEL")
+}
+
+func parseObjectIds(objectIdsStr string) ([]uint64, error) {
+	if objectIdsStr == "" {
+		objectIdsStr = defaultProtectedObjectIds
+	}
+
+	splitted := strings.Split(objectIdsStr, ",")
+	objectIds := make([]uint64, 0, len(splitted))
+	for _, objectIdStr := range splitted {
+		if objectIdStr = strings.TrimSpace(objectIdStr); objectIdStr == "" {
+			continue
+		}
+
+		objectId, err := strconv.ParseUint(objectIdStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		objectIds = append(objectIds, objectId)
+	}
+	return objectIds, nil
+}
+
+// read the configuration file and report the drift it corrects
+func reconcileConfig(ctx context.Context, logger *otelzap.Logger, managed *rightserver.Managed, store rightserver.Store, configPath string) error {
+	snapshot, err := readSnapshot(configPath)
+	if err != nil {
+		return err
+	}
+
+	changes, err := managed.Reconcile(ctx, store, snapshot)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		logger.WarnContext(ctx, "Drift from rights configuration corrected", zap.Stringer("change", change))
+	}
+	logger.InfoContext(ctx, "Rights configuration applied", zap.String("path", configPath), zap.Int("changes", len(changes)))
+	return nil
+}
+
+// which errors come from a conflict with a concurrent transaction
+func retryableFor(dialect string) func(error) bool {
+	if dialect == migration.SQLite {
+		return sqlite.IsRetryable
+	}
+	return postgres.IsRetryable
+}
+
+// with nativePgx, the store use its own pgx pool (with prepared statements) instead of db
+func newSQLStore(ctx context.Context, db *sql.DB, dbAddr string, nativePgx bool, retryable func(error) bool, isolation sql.IsolationLevel, notifyChannel string) (rightserver.Store, error) {
+	if !nativePgx {
+		return rightserver.NewSQLStore(db, retryable, isolation, notifyChannel), nil
+	}
+
+	config, err := pgxpool.ParseConfig(dbAddr)
+	if err != nil {
+		return nil, err
+	}
+	config.AfterConnect = rightserver.PrepareStatements
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return rightserver.NewPgxStore(pool, retryable, isolation, notifyChannel), nil
+}
+
+func parseDuration(durationStr string, defaultDuration time.Duration) (time.Duration, error) {
+	if durationStr = strings.TrimSpace(durationStr); durationStr == "" {
+		return defaultDuration, nil
+	}
+	return time.ParseDuration(durationStr)
+}
+
+// accept the names of sql.IsolationLevel ignoring case ("read committed", "serializable", ...)
+func parseIsolationLevel(levelStr string) (sql.IsolationLevel, error) {
+	if levelStr = strings.TrimSpace(levelStr); levelStr == "" {
+		return sql.LevelDefault, nil
+	}
+
+	for level := sql.LevelDefault; level <= sql.LevelLinearizable; level++ {
+		if strings.EqualFold(level.String(), levelStr) {
+			return level, nil
+		}
+	}
+	return sql.LevelDefault, errUnknownIsolationLevel
+}
@@ -0,0 +1,122 @@
+//go:build cgo
+
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// DriverName is the database/sql driver accepting the queries generated in the model package.
+const DriverName = "puzzlesqlite"
+
+const initConnQuery = "pragma foreign_keys = on; pragma busy_timeout = 5000;"
+
+// a deferred transaction which read before writing fails without waiting when another one write,
+// taking the write lock at the start make concurrent transactions wait for each other (with the busy timeout)
+const txLockParam = "_txlock="
+
+const defaultTxLock = txLockParam + "immediate"
+
+// the generated queries use Postgres placeholders ($1, $2, ...),
+// SQLite bind by position the parameters with a "$" prefix (it consider them as named),
+// the numbered form "?1, ?2, ..." has the same meaning
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+func init() {
+	sql.Register(DriverName, dialectDriver{inner: &sqlite3.SQLiteDriver{ConnectHook: initConn}})
+}
+
+// Open returns a database using the SQLite file at path (go-sqlite3 options can follow a "?").
+func Open(path string) (*sql.DB, error) {
+	return sql.Open(DriverName, path)
+}
+
+func initConn(conn *sqlite3.SQLiteConn) error {
+	_, err := conn.Exec(initConnQuery, nil)
+	return err
+}
+
+// IsRetryable returns true when err comes from a conflict with a concurrent transaction,
+// so the transaction can be retried.
+func IsRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return true
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func convertQuery(query string) string {
+	return placeholderRegexp.ReplaceAllString(query, "?$1")
+}
+
+type dialectDriver struct {
+	inner *sqlite3.SQLiteDriver
+}
+
+func (d dialectDriver) Open(name string) (driver.Conn, error) {
+	if !strings.Contains(name, txLockParam) {
+		separator := "?"
+		if strings.Contains(name, separator) {
+			separator = "&"
+		}
+		name += separator + defaultTxLock
+	}
+
+	conn, err := d.inner.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dialectConn{SQLiteConn: conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// dialectConn convert the queries before delegating to the SQLite connection
+type dialectConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c dialectConn) Prepare(query string) (driver.Stmt, error) {
+	return c.SQLiteConn.Prepare(convertQuery(query))
+}
+
+func (c dialectConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.SQLiteConn.PrepareContext(ctx, convertQuery(query))
+}
+
+func (c dialectConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.SQLiteConn.ExecContext(ctx, convertQuery(query), args)
+}
+
+func (c dialectConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.SQLiteConn.QueryContext(ctx, convertQuery(query), args)
+}
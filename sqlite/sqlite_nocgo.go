@@ -0,0 +1,37 @@
+//go:build !cgo
+
+/*
+ *
+ * Copyright 2023 puzzlerightserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// go-sqlite3 needs cgo, without it (like for static builds) only Postgres is available
+var errNoCgo = errors.New("SQLite support needs a build with cgo enabled")
+
+func Open(path string) (*sql.DB, error) {
+	return nil, errNoCgo
+}
+
+func IsRetryable(err error) bool {
+	return false
+}